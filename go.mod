@@ -2,4 +2,7 @@ module arachne
 
 go 1.24.6
 
-require github.com/biogo/hts v1.4.5
+require (
+	github.com/biogo/hts v1.4.5
+	github.com/klauspost/compress v1.18.0
+)
@@ -5,85 +5,253 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 
 	aligner "arachne/src/aligner"
+	fastqreader "arachne/src/fastqreader"
+	gobwa "arachne/src/gobwa"
 	preprocess "arachne/src/preprocess"
 )
 
+/*
+A subcommand of the arachne binary. run gets the arguments after the
+subcommand name and handles its own flags and --help.
+*/
+type subcommand struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+var subcommands = []subcommand{
+	{"align", "Align linked reads to a reference, using barcodes to place reads", align},
+	{"standardize", "Convert haplotagging, stLFR or TELLseq FASTQ into the standard format", preprocess.Standardize},
+	{"export", "Convert standard FASTQ back to haplotagging, stLFR or TELLseq", preprocess.Export},
+	{"preprocess", "Sort paired-end FASTQ by barcode", preprocess.Preprocess},
+	{"validate", "Check that FASTQ follows the standard format and is sorted by barcode", preprocess.Validate},
+	{"subsample", "Keep a fraction of barcodes, or cap the reads per barcode", preprocess.Subsample},
+	{"barcode-stats", "Report barcode, read length and quality statistics before aligning", preprocess.BarcodeStatsCommand},
+	{"index", "Build the BWA index of a reference FASTA", index},
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne <command> <options> <arguments>\n")
+	fmt.Fprint(os.Stderr, "\nArachne is an aligner for (short-read) linked-read data, along with the tools to prepare its input.\n")
+	fmt.Fprint(os.Stderr, "\n\033[35;1mCommands:\033[0m")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(os.Stderr, "\n  \033[35;1m%s\033[0m%s%s", cmd.name, strings.Repeat(" ", 15-len(cmd.name)), cmd.summary)
+	}
+	fmt.Fprint(os.Stderr, "\n\nRun \033[92;1marachne <command> --help\033[0m for the options of a command. Without a command, arachne aligns.")
+	fmt.Fprint(os.Stderr, "\nSee the documentation for more information: https://pdimens.github.io/arachne\n")
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		if len(os.Args) > 2 {
+			// "arachne help <command>" is the same as "arachne <command> --help"
+			os.Args = []string{os.Args[0], os.Args[2], "--help"}
+			name = os.Args[1]
+		} else {
+			printUsage()
+			return
+		}
+	}
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			cmd.run(os.Args[2:])
+			return
+		}
+	}
+	// without a command, "arachne <options> output.bam reference.fa ..." still aligns
+	if !strings.HasPrefix(name, "-") && len(os.Args) < 5 {
+		fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m unknown command \033[33;1m%s\033[0m\n", name)
+		printUsage()
+		os.Exit(1)
+	}
+	align(os.Args[1:])
+}
+
+/*
+The "arachne align" subcommand
+*/
+func align(args []string) {
+	flags := flag.NewFlagSet("align", flag.ExitOnError)
+
 	var centromeres string
 	var positionChunkSize int
 	var improperPairPenalty float64
 	var readGroups string
 	var sampleId string
 	var threads int
+	var unsorted bool
+	var tempDir string
+	var bucketMemory int
+	var minRFAReads int
+	var maxBarcodeReads int
+	var oversizedPolicy string
+	optimizerSettings := aligner.DefaultOptimizerSettings
+	var componentThreads int
+	moleculeModel := aligner.DefaultMoleculeModel
+	var estimateModel int
 	var debug_spoof bool = false
 
 	/*Command line arguments*/
 
-	flag.StringVar(&centromeres, "centromeres", "", "TSV with CEN<chrname> <chrname> <start> <stop>, other rows will be ignored")
-	flag.StringVar(&centromeres, "c", "", "TSV with CEN<chrname> <chrname> <start> <stop>, other rows will be ignored")
+	flags.StringVar(&centromeres, "centromeres", "", "TSV with CEN<chrname> <chrname> <start> <stop>, other rows will be ignored")
+	flags.StringVar(&centromeres, "c", "", "TSV with CEN<chrname> <chrname> <start> <stop>, other rows will be ignored")
+
+	flags.Float64Var(&improperPairPenalty, "improper-pair-penalty", -4.0, "Penalty for improper pair")
+	flags.Float64Var(&improperPairPenalty, "i", -4.0, "Penalty for improper pair")
+
+	flags.IntVar(&positionChunkSize, "partitions", 40000000, "Contig partition size (in bp) to speed up final BAM concatenation")
+	flags.IntVar(&positionChunkSize, "p", 40000000, "Contig partition size (in bp) to speed up final BAM concatenation")
+
+	flags.StringVar(&readGroups, "read-group", "sample:library:molecule:flowcell:lane", "Comma-separated list of read group IDs")
+	flags.StringVar(&readGroups, "r", "sample:library:molecule:flowcell:lane", "Comma-separated list of read group IDs")
+
+	flags.StringVar(&sampleId, "sample-id", "sample", "Sample name")
+	flags.StringVar(&sampleId, "s", "sample", "Sample name")
+
+	flags.IntVar(&threads, "threads", 8, "Number of threads")
+	flags.IntVar(&threads, "t", 8, "Number of threads")
+
+	flags.BoolVar(&unsorted, "unsorted", false, "Input is not sorted by barcode; bucket reads by barcode on disk before aligning")
+	flags.BoolVar(&unsorted, "u", false, "Input is not sorted by barcode; bucket reads by barcode on disk before aligning")
+
+	flags.StringVar(&tempDir, "tmpdir", "", "Directory for barcode bucket files (with --unsorted)")
 
-	flag.Float64Var(&improperPairPenalty, "improper-pair-penalty", -4.0, "Penalty for improper pair")
-	flag.Float64Var(&improperPairPenalty, "i", -4.0, "Penalty for improper pair")
+	flags.IntVar(&bucketMemory, "bucket-memory", 2048, "Memory budget (in MB) for replaying one barcode bucket (with --unsorted)")
 
-	flag.IntVar(&positionChunkSize, "partitions", 40000000, "Contig partition size (in bp) to speed up final BAM concatenation")
-	flag.IntVar(&positionChunkSize, "p", 40000000, "Contig partition size (in bp) to speed up final BAM concatenation")
+	flags.IntVar(&minRFAReads, "min-rfa-reads", fastqreader.DefaultMinRFAReads, "Fewest read pairs a valid barcode needs for RFA; smaller barcodes are aligned as ordinary pairs")
 
-	flag.StringVar(&readGroups, "read-group", "sample:library:molecule:flowcell:lane", "Comma-separated list of read group IDs")
-	flag.StringVar(&readGroups, "r", "sample:library:molecule:flowcell:lane", "Comma-separated list of read group IDs")
+	flags.IntVar(&maxBarcodeReads, "max-barcode-reads", 30000, "Most read pairs of one barcode to run RFA on at once")
+	flags.StringVar(&oversizedPolicy, "oversized-barcodes", "skip", "What to do with barcodes over --max-barcode-reads: skip (RFA), split (by genomic locality) or overflow (to an unaligned BAM)")
 
-	flag.StringVar(&sampleId, "sample-id", "sample", "Sample name")
-	flag.StringVar(&sampleId, "s", "sample", "Sample name")
+	flags.StringVar(&optimizerSettings.Strategy, "optimizer", optimizerSettings.Strategy, "How RFA places reads in molecules: greedy, anneal or exact")
+	flags.Int64Var(&optimizerSettings.Seed, "seed", optimizerSettings.Seed, "Seed for the annealing optimizer")
+	flags.Float64Var(&optimizerSettings.StartTemp, "anneal-start-temp", optimizerSettings.StartTemp, "Starting temperature for annealing")
+	flags.Float64Var(&optimizerSettings.EndTemp, "anneal-end-temp", optimizerSettings.EndTemp, "Final temperature for annealing")
+	flags.IntVar(&optimizerSettings.TemperatureSteps, "anneal-temp-steps", optimizerSettings.TemperatureSteps, "Number of temperatures to anneal through")
+	flags.IntVar(&optimizerSettings.SweepsPerTemp, "anneal-sweeps", optimizerSettings.SweepsPerTemp, "Passes over the molecules at each temperature")
+	flags.IntVar(&optimizerSettings.ExactMaxParts, "exact-max-molecules", optimizerSettings.ExactMaxParts, "Most candidate molecules the exact optimizer takes on; barcodes with more are placed greedily")
+	flags.BoolVar(&optimizerSettings.EarlyStop, "early-stop", optimizerSettings.EarlyStop, "Stop optimizing once a whole pass over the molecules moves no reads")
+	flags.IntVar(&componentThreads, "component-threads", 1, "Threads per barcode optimizing groups of molecules that share no reads")
 
-	flag.IntVar(&threads, "threads", 8, "Number of threads")
-	flag.IntVar(&threads, "t", 8, "Number of threads")
+	flags.Int64Var(&moleculeModel.MaxGap, "max-molecule-gap", moleculeModel.MaxGap, "Alignments further apart than this (in bp) start a new candidate molecule")
+	flags.IntVar(&moleculeModel.MinReads, "min-molecule-reads", moleculeModel.MinReads, "An active molecule has more than this many reads")
+	flags.Float64Var(&moleculeModel.MinConfidence, "min-molecule-confidence", moleculeModel.MinConfidence, "Fewest of the reads that could be placed in a molecule that must be for it to be active")
+	flags.Float64Var(&moleculeModel.SingletonProb, "singleton-prob", moleculeModel.SingletonProb, "Probability of a read being outside any molecule")
+	flags.Float64Var(&moleculeModel.Padding, "molecule-padding", moleculeModel.Padding, "Length (in bp) added to each molecule's span for its unsequenced ends")
+	flags.Float64Var(&moleculeModel.MoleculeCost, "molecule-cost", moleculeModel.MoleculeCost, "Log probability of each molecule with reads in it")
+	flags.Float64Var(&moleculeModel.ActiveReadCost, "active-read-cost", moleculeModel.ActiveReadCost, "Log probability of an active molecule, per read that could be placed in it")
+	flags.IntVar(&estimateModel, "estimate-model", 0, "Estimate the molecule gap, minimum reads, padding and singleton probability from this many barcodes first (0 to not)")
 
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne <options> output.bam reference.fa sample.R1.fq sample.R2.fq\n")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne align <options> output.bam reference.fa sample.R1.fq sample.R2.fq\n")
+		fmt.Fprint(os.Stderr, "       arachne align <options> output.bam reference.fa sample.interleaved.fq\n")
+		fmt.Fprint(os.Stderr, "       arachne align <options> output.bam reference.fa sample.unaligned.bam\n")
 
-		fmt.Fprint(os.Stderr, "\nArachne is an aligner for (short-read) linked-read data. Input FASTQs can be gzipped and come from any linked-read technology, provided they:")
-		fmt.Fprint(os.Stderr, "\n  - are a set of paired-end reads")
+		fmt.Fprint(os.Stderr, "\nArachne is an aligner for (short-read) linked-read data. Input FASTQs can be plain text, gzip/BGZF or zstd compressed and come from any linked-read technology, provided they:")
+		fmt.Fprint(os.Stderr, "\n  - are a set of paired-end reads, either as separate R1/R2 files or a single interleaved file (\033[92;1m-\033[0m for stdin)")
+		fmt.Fprint(os.Stderr, "\n    (unaligned BAM or CRAM grouped by read name also works, using \033[92;1mBX\033[0m/\033[92;1mVX\033[0m or \033[92;1mCB\033[0m/\033[92;1mRX\033[0m tags;\n      CRAM is decoded with \033[92;1msamtools\033[0m, which has to be on the PATH)")
 		fmt.Fprint(os.Stderr, "\n  - have barcodes in a \033[92;1mBX:Z\033[0m SAM tag (e.g. \033[92;1mBX:Z:ATGGACTAGA\033[0m)")
 		fmt.Fprint(os.Stderr, "\n  - have barcode validations (\033[92;1m0\033[0m|\033[92;1m1\033[0m) in a \033[92;1mVX:i\033[0m SAM tag (e.g. \033[92;1mVX:i:1\033[0m if valid)")
-		fmt.Fprint(os.Stderr, "\n  - are sorted by barcode\n")
+		fmt.Fprint(os.Stderr, "\n  - are sorted by barcode (or use \033[35;1m--unsorted\033[0m)\n")
 		fmt.Fprint(os.Stderr, "\nSee the documentation for more information: https://pdimens.github.io/arachne\n")
 
 		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m-c\033[0m/\033[35;1m--centromeres\033[0m\n\tTSV with CEN<chrname> <chrname> <start> <stop>, other rows will be ignored")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m-i\033[0m/\033[35;1m--improper-pair-penalty\033[0m\n\tPenalty for improper pair \033[90;1m(default: -4)\033[0m")
+		fmt.Fprintf(os.Stderr, "\n  \033[35;1m--min-rfa-reads\033[0m\n\tFewest read pairs a valid barcode needs for RFA; smaller barcodes and invalid ones (\033[92;1mVX:i:0\033[0m)\n\tare aligned as ordinary pairs \033[90;1m(default: %d)\033[0m", fastqreader.DefaultMinRFAReads)
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--max-barcode-reads\033[0m\n\tMost read pairs of one barcode to run RFA on at once \033[90;1m(default: 30000)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--oversized-barcodes\033[0m\n\tWhat to do with barcodes over \033[35;1m--max-barcode-reads\033[0m: \033[92;1mskip\033[0m RFA and align them as ordinary pairs, \033[92;1msplit\033[0m them\n\tby genomic locality and run RFA on each part, or \033[92;1moverflow\033[0m them unaligned into overflow/unaligned.bam\n\t\033[90;1m(default: skip)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--optimizer\033[0m\n\tHow RFA places reads in molecules: \033[92;1mgreedy\033[0m moves, simulated annealing (\033[92;1manneal\033[0m), or an \033[92;1mexact\033[0m\n\tbranch-and-bound search for barcodes with few candidate molecules \033[90;1m(default: greedy)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--seed\033[0m\n\tSeed for the annealing optimizer \033[90;1m(default: 1)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--anneal-start-temp\033[0m/\033[35;1m--anneal-end-temp\033[0m\n\tTemperatures annealing starts and ends at \033[90;1m(default: 1 and 0.001)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--anneal-temp-steps\033[0m\n\tNumber of temperatures to anneal through \033[90;1m(default: 10)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--anneal-sweeps\033[0m\n\tPasses over the molecules at each temperature \033[90;1m(default: 4)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--exact-max-molecules\033[0m\n\tMost candidate molecules the exact optimizer takes on; barcodes with more are placed greedily\n\t\033[90;1m(default: 10)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--early-stop\033[0m\n\tStop optimizing once a whole pass over the molecules moves no reads \033[90;1m(default: true)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--component-threads\033[0m\n\tThreads per barcode optimizing groups of molecules that share no reads, for barcodes with\n\tmany molecules such as stLFR's \033[90;1m(default: 1)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--max-molecule-gap\033[0m\n\tAlignments further apart than this (in bp) start a new candidate molecule \033[90;1m(default: 50000)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--min-molecule-reads\033[0m/\033[35;1m--min-molecule-confidence\033[0m\n\tAn active molecule has more than this many reads, and at least this fraction of the reads\n\tthat could be placed in it \033[90;1m(default: 4 and 0.1)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--singleton-prob\033[0m\n\tProbability of a read being outside any molecule \033[90;1m(default: 0.05)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--molecule-padding\033[0m\n\tLength (in bp) added to each molecule's span for its unsequenced ends \033[90;1m(default: 1000)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--molecule-cost\033[0m/\033[35;1m--active-read-cost\033[0m\n\tLog probability of each molecule with reads in it, and of an active molecule per read that\n\tcould be placed in it \033[90;1m(default: -3 and -0.5)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--estimate-model\033[0m\n\tBefore aligning, run RFA on this many barcodes and estimate the molecule gap, minimum reads,\n\tpadding and singleton probability from the molecules found; written to molecule_model.tsv.\n\tThe reads read ahead to find them, up to 1000 read pairs per barcode and 2,000,000 in all, are held\n\tin memory until they are aligned \033[90;1m(default: 0, off)\033[0m")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m-p\033[0m/\033[35;1m--partitions\033[0m\n\tContig partition size (in bp) to speed up final BAM concatenation \033[90;1m(default: 40000000)\033[0m")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m-r\033[0m/\033[35;1m--read-group\033[0m\n\tComma-separated list of read group IDs")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m-s\033[0m/\033[35;1m--sample-id\033[0m\n\tSample name \033[90;1m(default: sample)\033[0m")
-		fmt.Fprint(os.Stderr, "\n  \033[35;1m-t\033[0m/\033[35;1m--threads\033[0m\n\tNumber of threads \033[90;1m(default: 8)\033[0m\n")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-t\033[0m/\033[35;1m--threads\033[0m\n\tNumber of threads \033[90;1m(default: 8)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-u\033[0m/\033[35;1m--unsorted\033[0m\n\tInput is not sorted by barcode; bucket reads by barcode on disk before aligning")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--tmpdir\033[0m\n\tDirectory for barcode bucket files \033[90;1m(default: system temp dir)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--bucket-memory\033[0m\n\tMemory budget (in MB) for replaying one barcode bucket \033[90;1m(default: 2048)\033[0m\n")
 	}
 
-	flag.Parse()
-	if flag.NArg() != 4 {
-		if flag.NArg() != 0 {
-			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 4 positional arguments are required, but %d were given\n", flag.NArg())
+	flags.Parse(args)
+	if flags.NArg() != 3 && flags.NArg() != 4 {
+		if flags.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 3 or 4 positional arguments are required, but %d were given\n", flags.NArg())
 		}
-		flag.Usage()
+		flags.Usage()
 		os.Exit(1)
 	}
-	output := flag.Arg(0)
+	output := flags.Arg(0)
 
-	ref := flag.Arg(1)
+	ref := flags.Arg(1)
 	preprocess.FileExists(ref, "FASTA")
 
-	r1 := flag.Arg(2)
-	preprocess.FileExists(r1, "FASTQ")
+	r1 := flags.Arg(2)
+	if r1 != "-" {
+		preprocess.FileExists(r1, "FASTQ/BAM")
+	}
 
-	r2 := flag.Arg(3)
-	preprocess.FileExists(r2, "FASTQ")
+	// an empty R2 tells the aligner that R1 is interleaved FASTQ or unaligned BAM
+	r2 := ""
+	if flags.NArg() == 4 {
+		r2 = flags.Arg(3)
+		preprocess.FileExists(r2, "FASTQ")
+	}
 
 	if centromeres != "" {
 		preprocess.FileExists(centromeres, "Centromere")
 	}
+	if maxBarcodeReads < 1 {
+		log.Fatalf("\033[31;1mError:\033[0m --max-barcode-reads must be at least 1\n")
+	}
+	if _, err := aligner.ParseOversizedPolicy(oversizedPolicy); err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	if componentThreads < 1 {
+		log.Fatalf("\033[31;1mError:\033[0m --component-threads must be at least 1\n")
+	}
+	if err := optimizerSettings.Check(); err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	if err := moleculeModel.Check(); err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	if estimateModel < 0 {
+		log.Fatalf("\033[31;1mError:\033[0m --estimate-model can't be negative\n")
+	}
+	if estimateModel > 0 {
+		/* The estimate would overwrite these, so asking for both is a mistake */
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "max-molecule-gap", "min-molecule-reads", "singleton-prob", "molecule-padding":
+				log.Fatalf("\033[31;1mError:\033[0m --%s can't be given with --estimate-model, which estimates it\n", f.Name)
+			}
+		})
+	}
 
-	//TODO ADD PREPROCESS AND STANDARDIZE SUBCOMMANDS TO ARACHNE
-	args := aligner.ArachneArgs{
+	arachneArgs := aligner.ArachneArgs{
 		R1:                    &r1,
 		R2:                    &r2,
 		Improper_pair_penalty: &improperPairPenalty,
@@ -97,6 +265,53 @@ func main() {
 		DebugPrintMove:        &debug_spoof,
 		Reference:             &ref,
 		Centromeres:           &centromeres,
+		Unsorted:              &unsorted,
+		TempDir:               &tempDir,
+		BucketMemory:          &bucketMemory,
+		MinRFAReads:           &minRFAReads,
+		MaxBarcodeReads:       &maxBarcodeReads,
+		OversizedPolicy:       &oversizedPolicy,
+		Optimizer:             &optimizerSettings,
+		ComponentThreads:      &componentThreads,
+		MoleculeModel:         &moleculeModel,
+		EstimateModel:         &estimateModel,
+	}
+	aligner.Arachne(arachneArgs)
+}
+
+/*
+The "arachne index" subcommand
+*/
+func index(args []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	var prefix string
+
+	flags.StringVar(&prefix, "prefix", "", "Prefix of the index files")
+	flags.StringVar(&prefix, "p", "", "Prefix of the index files")
+
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne index <options> reference.fa\n")
+		fmt.Fprint(os.Stderr, "\nBuild the BWA index that \033[92;1marachne align\033[0m needs for a reference FASTA (plain or gzipped).\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-p\033[0m/\033[35;1m--prefix\033[0m\n\tPrefix of the index files \033[90;1m(default: the FASTA path)\033[0m\n")
+	}
+
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		if flags.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 1 positional argument (the reference FASTA) is required, but %d were given\n", flags.NArg())
+		}
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ref := flags.Arg(0)
+	preprocess.FileExists(ref, "FASTA")
+	if prefix == "" {
+		prefix = ref
+	}
+	if err := gobwa.GoBwaIndex(ref, prefix); err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
 	}
-	aligner.Arachne(args)
 }
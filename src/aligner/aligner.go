@@ -8,6 +8,7 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
 	"os"
@@ -22,6 +23,8 @@ import (
 	"arachne/src/fastqreader"
 	"arachne/src/gobwa"
 	"arachne/src/optimizer"
+
+	sam "github.com/biogo/hts/sam"
 )
 
 // build version -- get set statically by a linker flag
@@ -41,6 +44,29 @@ type ArachneArgs struct {
 	DebugPrintMove        *bool
 	Reference             *string
 	Centromeres           *string
+	Unsorted              *bool
+	TempDir               *string
+	BucketMemory          *int
+	MinRFAReads           *int
+	MaxBarcodeReads       *int
+	OversizedPolicy       *string
+	Optimizer             *optimizer.Settings
+	ComponentThreads      *int
+	MoleculeModel         *MoleculeModel
+	/* Barcodes to estimate the molecule model from before aligning, 0 to not */
+	EstimateModel *int
+}
+
+/* Greedy placement, as Arachne has always done it */
+var DefaultOptimizerSettings = optimizer.Settings{
+	Strategy:         "greedy",
+	Seed:             1,
+	StartTemp:        1,
+	EndTemp:          0.001,
+	TemperatureSteps: 10,
+	SweepsPerTemp:    4,
+	ExactMaxParts:    10,
+	EarlyStop:        true,
 }
 
 type ChainedHit struct {
@@ -75,6 +101,9 @@ type Alignment struct {
 	soft_clipped                      int
 	soft_clipped_length               int
 	barcode                           *[]byte
+	barcode_valid                     bool
+	input_tags                        *[]sam.Aux
+	mate_tags                         *[]sam.Aux
 	read_name                         *string
 	read_seq                          *[]byte
 	read_qual                         *[]byte
@@ -165,6 +194,16 @@ after set in main.
 */
 type RFAConfig struct {
 	improper_penalty float64
+	/* Barcodes with fewer read pairs than this are aligned without RFA */
+	min_rfa_reads int
+	/* Barcodes with more read pairs than fit in a work unit */
+	oversized *OversizedStats
+	/* Which optimizer to place reads in molecules with, and how to run it */
+	optimizer_settings optimizer.Settings
+	/* Goroutines per barcode optimizing independent components of its molecules */
+	component_threads int
+	/* Parameters of the molecule model */
+	model MoleculeModel
 }
 
 // types and functions to be able to sort a list of aligntments by position,
@@ -190,6 +229,7 @@ type CandidateMolecule struct {
 	differences             float64
 	soft_clipped            int
 	mismatchLocs            map[int]int
+	neighbors               []*CandidateMolecule // other molecules its reads could move to, in molecule order
 }
 
 type Optimizer struct {
@@ -200,6 +240,7 @@ type Optimizer struct {
 	currentScore              float64
 	log_unpaired_probability  float64
 	barcode                   string
+	model                     *MoleculeModel
 }
 
 /*
@@ -209,8 +250,17 @@ type WorkUnit struct {
 	reads          []fastqreader.FastQRecord
 	barcodenum     int
 	unique_barcode bool
+	/* A batch of reads with invalid barcodes, to align as ordinary pairs */
+	invalid_barcodes bool
+	/* All of an oversized barcode's reads, to split by genomic locality */
+	split bool
+	/* BWA's hits for each read pair, when they were mapped already */
+	hits [][2][]gobwa.EasyAlignment
 }
 
+/* Reads with invalid barcodes are handed to the workers this many pairs at a time */
+const invalidBatchSize = 5000
+
 /*
  * Holds statistics and coordination points for RFA
  */
@@ -237,10 +287,24 @@ func ReturnBuffer(reads []fastqreader.FastQRecord) {
 	barcode_reads_lock.Unlock()
 }
 
+/* Take an empty buffer for a barcode's reads, reusing one that was returned if possible */
+func GetBuffer() []fastqreader.FastQRecord {
+	barcode_reads_lock.Lock()
+	defer barcode_reads_lock.Unlock()
+	if len(barcode_reads) == 0 {
+		return make([]fastqreader.FastQRecord, 0, 50000)
+	}
+	reads := barcode_reads[len(barcode_reads)-1]
+	barcode_reads = barcode_reads[0 : len(barcode_reads)-1]
+	return reads[0:0]
+}
+
 type Data struct {
 	alignments [][]*Alignment
 	reads      []fastqreader.FastQRecord
 	attach_bx  bool
+	/* Write the reads to the overflow BAM unaligned instead */
+	overflow bool
 }
 
 /*Command line arguments*/
@@ -295,11 +359,23 @@ func Arachne(args ArachneArgs) {
 		panic(fmt.Sprintf("Output directory not writable by this process %s", *output))
 	}
 
-	fastq, err := fastqreader.OpenFastQ(*r1, *r2)
+	fastq, err := fastqreader.OpenPairedFastQ(*r1, *r2)
 
 	if err != nil {
 		panic(err)
 	}
+	if args.Unsorted != nil && *args.Unsorted {
+		/* Input isn't grouped by barcode, so spill it to disk and replay it grouped */
+		print("Bucketing reads by barcode\n")
+		fastq, err = fastqreader.BucketByBarcode(fastq, fastqreader.BucketConfig{
+			TempDir:      *args.TempDir,
+			MemoryBudget: int64(*args.BucketMemory) << 20,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error bucketing FASTQ input: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	print(fmt.Sprintf("Loading reference: %s\n", *reference))
 
 	ref := gobwa.GoBwaLoadReference(*reference)
@@ -308,6 +384,65 @@ func Arachne(args ArachneArgs) {
 	config := &RFAConfig{}
 
 	config.improper_penalty = float64(*improper_pair_penalty)
+	config.min_rfa_reads = fastqreader.DefaultMinRFAReads
+	if args.MinRFAReads != nil {
+		config.min_rfa_reads = *args.MinRFAReads
+	}
+	oversized := &OversizedStats{MaxReads: fastqreader.DefaultMaxBarcodeReads}
+	if args.MaxBarcodeReads != nil && *args.MaxBarcodeReads > 0 {
+		oversized.MaxReads = *args.MaxBarcodeReads
+	}
+	if args.OversizedPolicy != nil {
+		oversized.Policy, err = ParseOversizedPolicy(*args.OversizedPolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fastq.MaxBarcodeReads = oversized.MaxReads
+	config.oversized = oversized
+	config.optimizer_settings = DefaultOptimizerSettings
+	if args.Optimizer != nil {
+		config.optimizer_settings = *args.Optimizer
+	}
+	config.component_threads = 1
+	if args.ComponentThreads != nil {
+		config.component_threads = *args.ComponentThreads
+	}
+	if err := config.optimizer_settings.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.model = DefaultMoleculeModel
+	if args.MoleculeModel != nil {
+		config.model = *args.MoleculeModel
+	}
+	if err := config.model.Check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	/* Sets read ahead to estimate the molecule model from, aligned first */
+	var prefetched []prefetchedSet
+	var measured *moleculeSample
+	if args.EstimateModel != nil && *args.EstimateModel > 0 {
+		var sample [][]fastqreader.FastQRecord
+		prefetched, sample, err = prefetchSample(fastq, *args.EstimateModel, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading FASTQ input: %v\n", err)
+			os.Exit(1)
+		}
+		print(fmt.Sprintf("Estimating the molecule model from %d barcodes\n", len(sample)))
+		measured = measureMolecules(sample, ref, settings, config, *threads)
+		if model, ok := measured.estimate(config.model); ok {
+			config.model = model
+		} else {
+			print(fmt.Sprintf("Only %d molecules found to estimate from; keeping the molecule model as it was\n", len(measured.spacings)))
+		}
+	}
+	if err := writeMoleculeModel(*output, &config.model, measured); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing molecule model: %v\n", err)
+	}
 
 	var w *bufio.Writer
 
@@ -316,6 +451,17 @@ func Arachne(args ArachneArgs) {
 	if err != nil {
 		panic(err)
 	}
+	if oversized.Policy == OversizedOverflow {
+		/* Kept apart from the BAMs that get merged into the final output */
+		err = os.MkdirAll(*output+"/overflow", 0755)
+		if err != nil {
+			panic(err)
+		}
+		bams.OverflowBam, err = CreateBAM(ref, *output+"/overflow/unaligned.bam", *read_groups, *sample_id)
+		if err != nil {
+			panic(err)
+		}
+	}
 	work_to_do := make(chan *WorkUnit, 2)
 	//finished := make (chan bool);
 
@@ -336,25 +482,82 @@ func Arachne(args ArachneArgs) {
 		go WorkerThread(work_to_do, bams, ref, settings, config, stats, &worker_lock)
 	}
 
+	/* Reads with invalid barcodes don't make up read clouds, so rather than
+	 * grouping them by their (meaningless) barcode they are collected into
+	 * batches and aligned as ordinary pairs
+	 */
+	invalid_batch := GetBuffer()
+	/* With the "split" policy, the parts of an oversized barcode are
+	 * gathered here until all of them have been read
+	 */
+	var oversized_reads []fastqreader.FastQRecord
+	flush_oversized := func() {
+		if len(oversized_reads) > 0 {
+			barcode_num++
+			work_to_do <- &WorkUnit{reads: oversized_reads, barcodenum: barcode_num, split: true}
+			oversized_reads = nil
+		}
+	}
+	var last_oversized []byte
+
 	/* Iterate over source file, giving work to the workers */
 	for {
 		barcode_num++
-		if len(barcode_reads) == 0 {
-			barcode_reads_lock.Lock()
-			barcode_reads = append(barcode_reads, make([]fastqreader.FastQRecord, 0, 50000))
-			barcode_reads_lock.Unlock()
+		var bc_reads []fastqreader.FastQRecord
+		var full_barcode bool
+		if len(prefetched) > 0 {
+			bc_reads, full_barcode = prefetched[0].reads, prefetched[0].full
+			prefetched = prefetched[1:]
+		} else {
+			bc_reads = GetBuffer()
+			bc_reads, err, full_barcode = fastq.ReadBarcodeSet(&bc_reads)
 		}
-		barcode_reads_lock.Lock()
-		bc_reads := barcode_reads[len(barcode_reads)-1]
-		//fmt.Println(len(barcode_reads))
-		barcode_reads = barcode_reads[0 : len(barcode_reads)-1]
-		barcode_reads_lock.Unlock()
-		bc_reads, err, full_barcode := fastq.ReadBarcodeSet(&bc_reads)
 		if err != nil {
+			if err != io.EOF {
+				/* Malformed or out-of-sync input: stop rather than align nonsense pairs */
+				fmt.Fprintf(os.Stderr, "Error reading FASTQ input: %v\n", err)
+				os.Exit(1)
+			}
 			break
 		}
+		if len(oversized_reads) > 0 && fastqreader.DifferentBarcode(oversized_reads[0].Barcode, bc_reads[0].Barcode) {
+			flush_oversized()
+		}
 
-		work_to_do <- &WorkUnit{bc_reads, barcode_num, full_barcode}
+		if len(bc_reads) > 0 && !bc_reads[0].Valid {
+			invalid_batch = append(invalid_batch, bc_reads...)
+			ReturnBuffer(bc_reads)
+			if len(invalid_batch) >= invalidBatchSize {
+				work_to_do <- &WorkUnit{reads: invalid_batch, barcodenum: barcode_num, invalid_barcodes: true}
+				invalid_batch = GetBuffer()
+			}
+			continue
+		}
+		if !full_barcode {
+			/* Count each oversized barcode once, on its first part */
+			if last_oversized == nil || fastqreader.DifferentBarcode(last_oversized, bc_reads[0].Barcode) {
+				last_oversized = append(last_oversized[:0], bc_reads[0].Barcode...)
+				oversized.add(1, 0, 0, 0)
+			}
+			oversized.add(0, len(bc_reads), 0, 0)
+			switch oversized.Policy {
+			case OversizedSplit:
+				oversized_reads = append(oversized_reads, bc_reads...)
+				ReturnBuffer(bc_reads)
+				continue
+			case OversizedOverflow:
+				DumpToBams(&Data{reads: bc_reads, overflow: true}, bams)
+				continue
+			}
+		}
+		work_to_do <- &WorkUnit{reads: bc_reads, barcodenum: barcode_num, unique_barcode: full_barcode}
+	}
+	flush_oversized()
+	if len(invalid_batch) > 0 {
+		barcode_num++
+		work_to_do <- &WorkUnit{reads: invalid_batch, barcodenum: barcode_num, invalid_barcodes: true}
+	} else {
+		ReturnBuffer(invalid_batch)
 	}
 
 	/* Tell each worker to exit */
@@ -369,6 +572,9 @@ func Arachne(args ArachneArgs) {
 
 	/* Close and flush the BAM file */
 	bams.Close()
+	if err := oversized.Write(*output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing oversized barcode metrics: %v\n", err)
+	}
 	fmt.Println("Arachne completed successfully")
 }
 
@@ -413,6 +619,10 @@ func WorkerThread(input chan *WorkUnit,
 	worker_lock.RLock()
 
 	for work := <-input; work != nil; work = <-input {
+		if work.split {
+			SplitOversizedBarcode(work, bams, ref, settings, config, stats)
+			continue
+		}
 		DoRFAForOneBarcode(work, bams, ref, settings, config, stats, work.reads)
 	}
 	worker_lock.RUnlock()
@@ -450,15 +660,23 @@ func DoRFAForOneBarcode(work *WorkUnit,
 	//barcode_num := work.barcodenum
 	barcode_reads := work.reads
 	arena := gobwa.NewArena()
-	worthRunningRFA := worthRunningRFA(barcode_reads, work.unique_barcode)
-	barcode_chains, barcode := GetChains(ref, settings, barcode_reads, arena, 25)
+	worthRunningRFA := worthRunningRFA(barcode_reads, work.unique_barcode, config.min_rfa_reads)
+	var barcode_chains [][]ChainedHit
+	var barcode string
+	if work.hits != nil {
+		barcode_chains, barcode = chainsFromHits(barcode_reads, work.hits)
+	} else {
+		barcode_chains, barcode = GetChains(ref, settings, barcode_reads, arena, 25)
+	}
 	alignments, stashed_alignments := GetAlignments(ref, settings, barcode_chains, 17, arena)
 	//stashed_alignments := StashAlignments(alignments);
 
 	//	positions := tagBestAlignments(alignments, -17)
 	positions := tagBestAlignments(alignments)
 
-	if len(barcode_reads) > 2 {
+	if work.invalid_barcodes {
+		fmt.Printf("working on %d reads with invalid barcodes\n", len(barcode_reads))
+	} else if len(barcode_reads) > 2 {
 		fmt.Printf("working on barcode %s  num reads: %d  doing RFA: %v  unique_barcode %v \n",
 			string(barcode_reads[0].Barcode),
 			len(barcode_reads),
@@ -468,15 +686,30 @@ func DoRFAForOneBarcode(work *WorkUnit,
 
 	if !worthRunningRFA {
 		//estimateMapQualities(-1, alignments, nil, config.improper_penalty, stats)
-		estimateMapQualities(alignments, nil, config.improper_penalty)
-		markDuplicates(alignments)
+		estimateMapQualities(alignments, nil, config.improper_penalty, &config.model)
+		markDuplicates(alignments, barcode_reads)
 		CheckSplitReads(stashed_alignments, centromeres)
-		DumpToBams(&Data{alignments: alignments, reads: reads, attach_bx: work.unique_barcode}, bams)
+		DumpToBams(&Data{alignments: alignments, reads: reads, attach_bx: work.unique_barcode || work.invalid_barcodes}, bams)
 		arena.Free()
 		return
 	}
 
-	candidate_molecules := inferMolecules(positions)
+	optimized := placeReadsInMolecules(alignments, positions, barcode, config)
+
+	//estimateMapQualities(barcode_num, optimized.alignments, optimized.candidate_molecules, optimized.log_unpaired_probability, stats)
+	estimateMapQualities(optimized.alignments, optimized.candidate_molecules, optimized.log_unpaired_probability, optimized.model)
+	markDuplicates(alignments, barcode_reads)
+	CheckSplitReads(stashed_alignments, centromeres)
+	DumpToBams(&Data{alignments: optimized.alignments, reads: reads, attach_bx: true}, bams)
+	arena.Free()
+}
+
+/*
+ * Group a barcode's alignments into candidate molecules and optimize which
+ * molecule each read is placed in
+ */
+func placeReadsInMolecules(alignments [][]*Alignment, positions [][]*Alignment, barcode string, config *RFAConfig) Optimizer {
+	candidate_molecules := inferMolecules(positions, &config.model)
 	markBestAlignmentForReadInMolecule(candidate_molecules)
 	candidate_molecules = scrapMolecules(candidate_molecules)
 
@@ -488,16 +721,12 @@ func DoRFAForOneBarcode(work *WorkUnit,
 		currentMoleculeMoveSource: 0,
 		log_unpaired_probability:  config.improper_penalty,
 		barcode:                   barcode,
+		model:                     &config.model,
 	}
 
-	optimized := optimizer.Optimize(optimizer.Optimizable(*optimizer_obj), 1, 2, 4*len(candidate_molecules)).(Optimizer)
-
-	//estimateMapQualities(barcode_num, optimized.alignments, optimized.candidate_molecules, optimized.log_unpaired_probability, stats)
-	estimateMapQualities(optimized.alignments, optimized.candidate_molecules, optimized.log_unpaired_probability)
-	markDuplicates(alignments)
-	CheckSplitReads(stashed_alignments, centromeres)
-	DumpToBams(&Data{optimized.alignments, reads, true}, bams)
-	arena.Free()
+	optimizeComponents(linkMolecules(candidate_molecules), *optimizer_obj, config)
+	/* Moves change the molecules and alignments in place */
+	return *optimizer_obj
 }
 
 func DeAlignCrappyReads(reads [][]*Alignment) {
@@ -597,6 +826,7 @@ func SetArgsForTests(args ArachneArgs) {
 
 // If two reads have the same value, then they are duplicates
 type readDupTuple struct {
+	barcode    string
 	read1      bool
 	reversed   bool
 	contig     string
@@ -608,7 +838,9 @@ type readDupTuple struct {
 // For each read, make a tuple of (bc_sequence, read.is_read1, read.is_reverse, read.tid, read.pos, read.mrnm, read.mpos)
 // reads with an equal value of this tuple are defined as duplicates or one another.
 // mark all but 1 read in each group as a duplicate
-func markDuplicates(alignments [][]*Alignment) {
+// reads holds the pairs the alignments were made from, so that a batch of
+// reads with invalid barcodes only marks duplicates within each barcode
+func markDuplicates(alignments [][]*Alignment, reads []fastqreader.FastQRecord) {
 
 	dupSeen := make(map[readDupTuple]bool)
 
@@ -620,6 +852,7 @@ func markDuplicates(alignments [][]*Alignment) {
 				mateAlignment := alignment.mate_alignment
 
 				readTuple := readDupTuple{
+					barcode:    string(reads[alignment.read_id/2].Barcode),
 					read1:      alignment.read1,
 					reversed:   alignment.reversed,
 					contig:     alignment.contig,
@@ -640,7 +873,12 @@ func markDuplicates(alignments [][]*Alignment) {
 	}
 }
 
-func updateAlignmentsMoleculeStatus(alignments [][]*Alignment, candidate_molecules []*CandidateMolecule, read_copies_in_active_molecule, read_copies_not_in_active_molecule map[int]int, unique_molecules_active map[int]map[int]bool) {
+/* Does a molecule have enough reads, placed confidently enough, to be active? */
+func isMoleculeActive(molecule *CandidateMolecule, model *MoleculeModel) bool {
+	return molecule.active_alignments.Len()-molecule.soft_clipped > model.MinReads && molecule.molecule_confidence > model.MinConfidence
+}
+
+func updateAlignmentsMoleculeStatus(alignments [][]*Alignment, candidate_molecules []*CandidateMolecule, read_copies_in_active_molecule, read_copies_not_in_active_molecule map[int]int, unique_molecules_active map[int]map[int]bool, model *MoleculeModel) {
 	if candidate_molecules != nil {
 		setMoleculeConfidences(candidate_molecules)
 		setMoleculeDifferences(candidate_molecules, false)
@@ -652,7 +890,7 @@ func updateAlignmentsMoleculeStatus(alignments [][]*Alignment, candidate_molecul
 				is_molecule_active := false
 				if alignment.molecule_id != -1 {
 					molecule := candidate_molecules[alignment.molecule_id]
-					is_molecule_active = molecule.active_alignments.Len()-molecule.soft_clipped > 4 && molecule.molecule_confidence > 0.1
+					is_molecule_active = isMoleculeActive(molecule, model)
 					alignment.active_molecule = is_molecule_active
 				}
 				if is_molecule_active {
@@ -694,12 +932,9 @@ func appendPsuedocountAlignmentScore(scores []float64, alignmentArray []*Alignme
 	return scores
 }
 
-func moleculeMapqProbabilitySums(candidate_molecules []*CandidateMolecule, log_unpaired_probability float64) {
-	for mol_id, sourceMolecule := range candidate_molecules {
-		for mol2_id, sinkMolecule := range candidate_molecules {
-			if mol_id == mol2_id {
-				continue
-			}
+func moleculeMapqProbabilitySums(candidate_molecules []*CandidateMolecule, log_unpaired_probability float64, model *MoleculeModel) {
+	for _, sourceMolecule := range candidate_molecules {
+		for _, sinkMolecule := range sourceMolecule.neighbors {
 			sourceAlignments := []*Alignment{}
 			for _, aln := range sourceMolecule.active_alignments.Iter() {
 				alt_aln := sinkMolecule.best_alignment_for_read.Get(aln.read_id)
@@ -707,7 +942,7 @@ func moleculeMapqProbabilitySums(candidate_molecules []*CandidateMolecule, log_u
 					sourceAlignments = append(sourceAlignments, aln)
 				}
 			}
-			sourceSinkChange, _ := fastScore(sourceMolecule, sinkMolecule, log_unpaired_probability)
+			sourceSinkChange, _ := fastScore(sourceMolecule, sinkMolecule, log_unpaired_probability, model)
 			moleculeMoveProbability := math.Pow(10, sourceSinkChange)
 			for _, alignment := range sourceAlignments {
 				if !alignment.active {
@@ -719,8 +954,8 @@ func moleculeMapqProbabilitySums(candidate_molecules []*CandidateMolecule, log_u
 	}
 }
 
-func calculateLogMoleculePenalty(candidate_molecules []*CandidateMolecule, referenceLength float64) float64 {
-	dnaLength := 1000.0
+func calculateLogMoleculePenalty(candidate_molecules []*CandidateMolecule, referenceLength float64, model *MoleculeModel) float64 {
+	dnaLength := model.Padding
 	numMolecules := 0
 	if len(candidate_molecules) == 0 {
 		return 0.0
@@ -740,7 +975,7 @@ func calculateLogMoleculePenalty(candidate_molecules []*CandidateMolecule, refer
 				}
 			}
 			if biggest >= smallest {
-				dnaLength += float64(biggest-smallest) + 1000.0
+				dnaLength += float64(biggest-smallest) + model.Padding
 			}
 		} else {
 			for _, alignment := range mol.active_alignments.Iter() {
@@ -748,7 +983,7 @@ func calculateLogMoleculePenalty(candidate_molecules []*CandidateMolecule, refer
 			}
 		}
 	}
-	singletonProb := 0.05
+	singletonProb := model.SingletonProb
 	moleculePenalty := math.Log10(dnaLength / referenceLength * singletonProb)
 	return moleculePenalty
 
@@ -798,21 +1033,19 @@ func estimateMapQualities( //barcode int, //TODO remove, this isn't used
 	alignments [][]*Alignment,
 	candidate_molecules []*CandidateMolecule,
 	log_unpaired_probability float64,
+	model *MoleculeModel,
 	//stats *RFAStats    //TODO remove, this isn't used
 ) {
 	read_copies_in_active_molecule := map[int]int{}     //TODO remove, book keeping
 	read_copies_not_in_active_molecule := map[int]int{} //TODO remove, book keeping
 	unique_molecules_active := map[int]map[int]bool{}
-	// mapq strategy 2: sum probabilities of full molecule moves
-	if *debugPrintMove {
-		fmt.Println("NOW TESTING MAPQS")
-	}
-	moleculeMapqProbabilitySums(candidate_molecules, log_unpaired_probability)
+	// mapq strategy 2: sum probabilities of full molecule moves, which optimizeComponents
+	// has already done for each component of candidate_molecules
 
 	// Now to update alignment probabilities for being singleton/outside active molecules
 	// this part only happens if we ran RFA, bad barcodes etc get no more probability updates
-	updateAlignmentsMoleculeStatus(alignments, candidate_molecules, read_copies_in_active_molecule, read_copies_not_in_active_molecule, unique_molecules_active)
-	log_molecule_penalty := calculateLogMoleculePenalty(candidate_molecules, 3200000000.0) //hard coding length of human reference
+	updateAlignmentsMoleculeStatus(alignments, candidate_molecules, read_copies_in_active_molecule, read_copies_not_in_active_molecule, unique_molecules_active, model)
+	log_molecule_penalty := calculateLogMoleculePenalty(candidate_molecules, 3200000000.0, model) //hard coding length of human reference
 	//now go through every read_id and normalize all alternate alignment probabilities
 	for read_id, alignmentArray := range alignments {
 		// find best pair for alignments and make list of those alignment pair scores for use of probability normalization to sum to 1.0
@@ -886,7 +1119,7 @@ func estimateMapQualities( //barcode int, //TODO remove, this isn't used
 				alignment.mapq_data.copies_outside_active_molecules = read_copies_not_in_active_molecule[read_id]
 				alignment.mapq_data.unique_molecules_active = len(unique_molecules_active[read_id])
 				alignment.mapq_data.score = scoreAlignment(alignment, alignment.mate_alignment, 0.0) // for the purposes of the AS bam tag, want pair alignment score without molecule penalties
-				debugStrings(alignment, alignments, candidate_molecules, debug_strings, log_unpaired_probability)
+				debugStrings(alignment, alignments, candidate_molecules, debug_strings, log_unpaired_probability, model)
 			}
 		}
 
@@ -921,7 +1154,7 @@ func estimateMapQualities( //barcode int, //TODO remove, this isn't used
 	checkMates(alignments)
 }
 
-func debugStrings(alignment *Alignment, alignments [][]*Alignment, candidate_molecules []*CandidateMolecule, debug_strings map[int]map[int]string, log_unpaired_probability float64) {
+func debugStrings(alignment *Alignment, alignments [][]*Alignment, candidate_molecules []*CandidateMolecule, debug_strings map[int]map[int]string, log_unpaired_probability float64, model *MoleculeModel) {
 	if *DEBUG {
 		alt_alignments := alignments[alignment.read_id]
 		for _, alignment_alt := range alt_alignments {
@@ -953,8 +1186,8 @@ func debugStrings(alignment *Alignment, alignments [][]*Alignment, candidate_mol
 
 					ST := strconv.FormatInt(int64(sourcesink), 10)
 					TS := strconv.FormatInt(int64(sinksource), 10)
-					sourcesinkchange, _ := fastScore(candidate_molecules[alignment.molecule_id], candidate_molecules[alignment_alt.molecule_id], log_unpaired_probability)
-					sinksourcechange, _ := fastScore(candidate_molecules[alignment_alt.molecule_id], candidate_molecules[alignment.molecule_id], log_unpaired_probability)
+					sourcesinkchange, _ := fastScore(candidate_molecules[alignment.molecule_id], candidate_molecules[alignment_alt.molecule_id], log_unpaired_probability, model)
+					sinksourcechange, _ := fastScore(candidate_molecules[alignment_alt.molecule_id], candidate_molecules[alignment.molecule_id], log_unpaired_probability, model)
 					active := strconv.FormatInt(int64(candidate_molecules[alignment_alt.molecule_id].active_alignments.Len()), 10)
 					spots := strconv.FormatInt(int64(candidate_molecules[alignment_alt.molecule_id].best_alignment_for_read.Len()), 10)
 					STC := strconv.FormatInt(int64(sourcesinkchange), 10)
@@ -1015,15 +1248,18 @@ func scrapMolecules(candidate_molecules []*CandidateMolecule) []*CandidateMolecu
 	return toReturn
 }
 
-func worthRunningRFA(barcode_reads []fastqreader.FastQRecord, uniqueBarcode bool) bool {
+/*
+ * RFA only makes sense for a whole read cloud: all of a valid barcode's reads,
+ * and enough of them to say something about the molecules they came from.
+ */
+func worthRunningRFA(barcode_reads []fastqreader.FastQRecord, uniqueBarcode bool, minReads int) bool {
 	if len(barcode_reads) == 0 || !uniqueBarcode {
 		return false
 	}
-	bcParts := strings.Split(string(barcode_reads[0].Barcode), "-")
-	if len(bcParts) < 2 {
+	if len(barcode_reads[0].Barcode) == 0 || !barcode_reads[0].Valid {
 		return false
 	}
-	if len(barcode_reads) < 5 {
+	if len(barcode_reads) < minReads {
 		return false
 	}
 	return true
@@ -1062,22 +1298,22 @@ func isPair(read1, read2 *Alignment) bool {
 	return dist >= int64(-35) && dist < int64(750)
 }
 
-func (o Optimizer) GenerateMove(accept_move func(p_curr float64, p_next float64) bool) optimizer.Optimizable {
+/*
+ * Propose the best move of reads out of the current source molecule and make
+ * it if accept_move agrees. A move that changes nothing but leaves the reads in
+ * the bigger molecule is always made.
+ */
+func (o Optimizer) GenerateMove(accept_move func(p_curr float64, p_next float64) bool) (optimizer.Optimizable, bool) {
 	sourceMolecule := o.candidate_molecules[o.currentMoleculeMoveSource]
 
 	if sourceMolecule.active_alignments.Len() == 0 {
 		o.currentMoleculeMoveSource = (o.currentMoleculeMoveSource + 1) % len(o.candidate_molecules)
-		return o
+		return o, false
 	}
-	var sinkMolecule *CandidateMolecule
 	best_move := Move{score_change: -math.MaxFloat64}
 
-	for i := 0; i < len(o.candidate_molecules); i++ {
-		if i == o.currentMoleculeMoveSource {
-			continue
-		}
-		sinkMolecule = o.candidate_molecules[i]
-
+	/* Only molecules sharing reads with the source can take any of them */
+	for _, sinkMolecule := range sourceMolecule.neighbors {
 		score, move := o.fastScore(sourceMolecule, sinkMolecule)
 
 		if (score > best_move.score_change ||
@@ -1087,13 +1323,16 @@ func (o Optimizer) GenerateMove(accept_move func(p_curr float64, p_next float64)
 	}
 
 	best_score := best_move.score_change
+	moved := false
 
-	if best_score > 0 || (best_score == 0 && best_move.sink.active_alignments.Len() > sourceMolecule.active_alignments.Len()) {
+	if best_move.num_moved > 0 && (accept_move(0, best_score) ||
+		(best_score == 0 && best_move.sink.active_alignments.Len() > sourceMolecule.active_alignments.Len())) {
 		acceptMove(best_move)
+		moved = true
 	}
 
 	o.currentMoleculeMoveSource = (o.currentMoleculeMoveSource + 1) % len(o.candidate_molecules)
-	return o
+	return o, moved
 }
 
 type Move struct {
@@ -1106,7 +1345,7 @@ type Move struct {
 	num_moved        int
 }
 
-func fastScore(sourceMolecule, sinkMolecule *CandidateMolecule, log_unpaired_probability float64) (float64, Move) {
+func fastScore(sourceMolecule, sinkMolecule *CandidateMolecule, log_unpaired_probability float64, model *MoleculeModel) (float64, Move) {
 	//initialization
 	change := float64(0)
 	alignment_change := float64(0)
@@ -1198,32 +1437,32 @@ func fastScore(sourceMolecule, sinkMolecule *CandidateMolecule, log_unpaired_pro
 		}
 	}
 
-	source_active_before := isActiveMolecule(sourceMolecule, 0)
-	source_active_after := isActiveMolecule(sourceMolecule, -num)
+	source_active_before := isActiveMolecule(sourceMolecule, 0, model)
+	source_active_after := isActiveMolecule(sourceMolecule, -num, model)
 	if !source_active_after && source_active_before && sourceMolecule.id != sinkMolecule.id {
-		change -= float64(sourceMolecule.best_alignment_for_read.Len()) * -0.5
+		change -= float64(sourceMolecule.best_alignment_for_read.Len()) * model.ActiveReadCost
 		if *debugPrintMove {
-			fmt.Println(">>> source killed adding ", -float64(sourceMolecule.best_alignment_for_read.Len())*-0.5)
+			fmt.Println(">>> source killed adding ", -float64(sourceMolecule.best_alignment_for_read.Len())*model.ActiveReadCost)
 		}
 	}
-	sink_active_before := isActiveMolecule(sinkMolecule, 0)
-	sink_active_after := isActiveMolecule(sinkMolecule, num)
+	sink_active_before := isActiveMolecule(sinkMolecule, 0, model)
+	sink_active_after := isActiveMolecule(sinkMolecule, num, model)
 	if sink_active_after && !sink_active_before && sourceMolecule.id != sinkMolecule.id {
-		change += float64(sinkMolecule.best_alignment_for_read.Len()) * -0.5
+		change += float64(sinkMolecule.best_alignment_for_read.Len()) * model.ActiveReadCost
 		if *debugPrintMove {
-			fmt.Println(">>> sink created adding ", float64(sinkMolecule.best_alignment_for_read.Len())*-0.5)
+			fmt.Println(">>> sink created adding ", float64(sinkMolecule.best_alignment_for_read.Len())*model.ActiveReadCost)
 		}
 	}
 	if sourceMolecule.active_alignments.Len()-num == 0 && num > 0 && sourceMolecule.id != sinkMolecule.id {
-		change -= -3.0
+		change -= model.MoleculeCost
 		if *debugPrintMove {
-			fmt.Println(">>>>>> adding 3")
+			fmt.Println(">>>>>> adding ", -model.MoleculeCost)
 		}
 	}
 	if sinkMolecule.active_alignments.Len() == 0 && num > 0 && sourceMolecule.id != sinkMolecule.id {
-		change += -3.0
+		change += model.MoleculeCost
 		if *debugPrintMove {
-			fmt.Println(">>>>>> adding -3")
+			fmt.Println(">>>>>> adding ", model.MoleculeCost)
 		}
 	}
 	change += alignment_change
@@ -1236,20 +1475,20 @@ func fastScore(sourceMolecule, sinkMolecule *CandidateMolecule, log_unpaired_pro
 	return change, Move{source: sourceMolecule, sink: sinkMolecule, toDelete: toDelete, toSet: toSet, num_moved: num, score_change: change, alignment_change: alignment_change}
 }
 
-func isActiveMolecule(mol *CandidateMolecule, read_change int) bool {
+func isActiveMolecule(mol *CandidateMolecule, read_change int, model *MoleculeModel) bool {
 	active := float64(mol.active_alignments.Len() + read_change)
 	potential := float64(mol.best_alignment_for_read.Len())
-	if active <= 4 {
+	if active <= float64(model.MinReads) {
 		return false
 	}
-	if active/potential < 0.1 {
+	if active/potential < model.MinConfidence {
 		return false
 	}
 	return true
 }
 
 func (o Optimizer) fastScore(sourceMolecule, sinkMolecule *CandidateMolecule) (float64, Move) {
-	change, move := fastScore(sourceMolecule, sinkMolecule, o.log_unpaired_probability)
+	change, move := fastScore(sourceMolecule, sinkMolecule, o.log_unpaired_probability, o.model)
 	return change, move
 }
 
@@ -1297,13 +1536,13 @@ func acceptMove(move Move) {
 	}
 }
 
-func inferMolecules(positions [][]*Alignment) []*CandidateMolecule {
+func inferMolecules(positions [][]*Alignment, model *MoleculeModel) []*CandidateMolecule {
 	toReturn := []*CandidateMolecule{}
 	molecule_num := 0
 	var currentMolecule *CandidateMolecule
 	for _, position_list := range positions {
 		for i := 0; i < len(position_list); i++ {
-			if i == 0 || (i > 0 && position_list[i].pos-position_list[i-1].pos > 50000) {
+			if i == 0 || (i > 0 && position_list[i].pos-position_list[i-1].pos > model.MaxGap) {
 				if i > 0 {
 					currentMolecule.stop = position_list[i-1].pos
 				}
@@ -1600,6 +1839,9 @@ func GetAlignments(ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, bar
 				read1:               chain.read1,
 				mapq_data:           &MapQData{active_alignments_in_molecules: ""},
 				barcode:             &chain.fastq.Barcode,
+				barcode_valid:       chain.fastq.Valid,
+				input_tags:          &chain.fastq.Tags,
+				mate_tags:           &chain.fastq.MateTags[mateIndex(chain.read1)],
 				contig:              alignment.Chrom,
 				pos:                 pos,
 				molecule_id:         -1,
@@ -1631,11 +1873,25 @@ func GetAlignments(ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, bar
 }
 
 func GetChains(ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, reads_for_barcode []fastqreader.FastQRecord, arena *gobwa.Arena, score_delta int) ([][]ChainedHit, string) {
+	return chainsFromHits(reads_for_barcode, mapReadPairs(ref, settings, reads_for_barcode, arena, score_delta))
+}
+
+/* BWA's hits for each read pair, R1's then R2's. They live as long as the arena. */
+func mapReadPairs(ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, reads []fastqreader.FastQRecord, arena *gobwa.Arena, score_delta int) [][2][]gobwa.EasyAlignment {
+	hits := make([][2][]gobwa.EasyAlignment, len(reads))
+	for i := range reads {
+		hits[i][0], hits[i][1] = gobwa.GoBwaMemMateSW(ref, settings, &reads[i].Read1, &reads[i].Read2, arena, score_delta)
+	}
+	return hits
+}
+
+/* The chains for each read of a barcode, from the hits mapReadPairs found for them */
+func chainsFromHits(reads_for_barcode []fastqreader.FastQRecord, hits [][2][]gobwa.EasyAlignment) ([][]ChainedHit, string) {
 	toReturn := [][]ChainedHit{}
 	hit_num := 0
 	var barcode string
 	for i := range reads_for_barcode {
-		read1_chains, read2_chains := gobwa.GoBwaMemMateSW(ref, settings, &reads_for_barcode[i].Read1, &reads_for_barcode[i].Read2, arena, score_delta)
+		read1_chains, read2_chains := hits[i][0], hits[i][1]
 		barcode = string(reads_for_barcode[i].Barcode)
 		read1_num := 0
 		toReturn = append(toReturn, []ChainedHit{})
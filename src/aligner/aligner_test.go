@@ -0,0 +1,75 @@
+package aligner
+
+import (
+	"strings"
+	"testing"
+
+	"arachne/src/fastqreader"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/* Read pairs that all align to the same place, one per barcode given */
+func samePlacePairs(barcodes ...string) ([][]*Alignment, []fastqreader.FastQRecord) {
+	var alignments [][]*Alignment
+	var reads []fastqreader.FastQRecord
+	for i, barcode := range barcodes {
+		reads = append(reads, fastqreader.FastQRecord{Barcode: []byte(barcode)})
+		read1 := &Alignment{id: 2 * i, read_id: 2 * i, read1: true, contig: "chr1", pos: 1000, active: true}
+		read2 := &Alignment{id: 2*i + 1, read_id: 2*i + 1, contig: "chr1", pos: 1300, reversed: true, active: true}
+		read1.mate_alignment, read2.mate_alignment = read2, read1
+		alignments = append(alignments, []*Alignment{read1}, []*Alignment{read2})
+	}
+	return alignments, reads
+}
+
+func TestMarkDuplicatesWithinBarcode(t *testing.T) {
+	tests := []struct {
+		name     string
+		barcodes []string
+		want     []bool
+	}{
+		{"one barcode", []string{"A01C01B01D01", "A01C01B01D01"}, []bool{false, true}},
+		/* A batch of reads with invalid barcodes mixes unrelated barcodes */
+		{"two invalid barcodes", []string{"A00C01B01D01", "A01C00B01D01"}, []bool{false, false}},
+		{"two invalid barcodes, one repeated", []string{"A00C01B01D01", "A01C00B01D01", "A00C01B01D01"}, []bool{false, false, true}},
+	}
+	for _, test := range tests {
+		alignments, reads := samePlacePairs(test.barcodes...)
+		markDuplicates(alignments, reads)
+		for pair, want := range test.want {
+			for _, aln := range alignments[2*pair : 2*pair+2] {
+				if aln[0].duplicate != want {
+					t.Errorf("%s: read %d duplicate %v, want %v", test.name, aln[0].read_id, aln[0].duplicate, want)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendInputTagsPerMate(t *testing.T) {
+	parse := func(fields ...string) []sam.Aux {
+		var tags []sam.Aux
+		for _, field := range fields {
+			aux, err := sam.ParseAux([]byte(field))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags = append(tags, aux)
+		}
+		return tags
+	}
+	shared := parse("RX:Z:ACGT", "MI:i:3")
+	mates := [2][]sam.Aux{parse("XA:Z:r1"), parse("XA:Z:r2", "XB:i:2")}
+	/* Tags Arachne writes itself win */
+	computed := parse("MI:i:9")
+	for mate, want := range []string{"MI:i:9 RX:Z:ACGT XA:Z:r1", "MI:i:9 RX:Z:ACGT XA:Z:r2 XB:i:2"} {
+		var got []string
+		for _, aux := range appendInputTags(append([]sam.Aux(nil), computed...), &shared, &mates[mate]) {
+			got = append(got, aux.String())
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("mate %d tags %q, want %q", mate+1, strings.Join(got, " "), want)
+		}
+	}
+}
@@ -37,6 +37,8 @@ type BAMWriters struct {
 	 * for the mutex to be unlocked to ensure data is flushed before continueing
 	 */
 	done sync.RWMutex
+	/* Unaligned reads of oversized barcodes, with the "overflow" policy */
+	OverflowBam *BAMWriter
 }
 
 // TODO FIGURE OUT WHAT REFERENCE ACTUALLY IS
@@ -124,7 +126,7 @@ func CreateBAM(ref *gobwa.GoBwaReference, path, read_groups, sample_id string) (
 	return bw, nil
 }
 
-func (b BAMWriters) getPositionBucketedBamForAlignment(aln *Alignment, unmapped bool) *BAMWriter {
+func (b *BAMWriters) getPositionBucketedBamForAlignment(aln *Alignment, unmapped bool) *BAMWriter {
 	if unmapped {
 		return b.PositionBucketedBams["unmapped"][0]
 	}
@@ -386,7 +388,6 @@ func (b *BAMWriter) AppendBam(aln *Alignment, primary *Alignment, debugTags bool
 	b.Record.Seq = sam.NewSeq(seq)
 	b.Record.Qual = fixQual(qual)
 
-	barcode := strings.Split(string(*aln.barcode), "-")
 	aux := []sam.Aux{}
 	as := auxify_int("AS", aln.score)
 	//	qx := auxify_string([]byte("QX"), *aln.barcode_qual)
@@ -552,10 +553,14 @@ func (b *BAMWriter) AppendBam(aln *Alignment, primary *Alignment, debugTags bool
 		aux = append(aux, sam.Aux(ac))
 		aux = append(aux, sam.Aux(pc))
 	}
-	if len(barcode) > 1 && attach_bx {
+	if len(*aln.barcode) > 0 && attach_bx {
 		bx := auxify_string([]byte("BX"), *aln.barcode)
 		aux = append(aux, sam.Aux(bx))
-		vx := auxify_int("VX", 1)
+		valid := 0
+		if aln.barcode_valid {
+			valid = 1
+		}
+		vx := auxify_int("VX", valid)
 		aux = append(aux, sam.Aux(vx))
 
 		if aln.active_molecule {
@@ -563,10 +568,45 @@ func (b *BAMWriter) AppendBam(aln *Alignment, primary *Alignment, debugTags bool
 			aux = append(aux, sam.Aux(md))
 		}
 	}
+	aux = appendInputTags(aux, aln.input_tags, aln.mate_tags)
 	b.Record.AuxFields = aux
 	b.Writer.Write(&b.Record)
 }
 
+/*
+ * Carry the SAM tags that came in with the read (RX, QX, MI, ...) through to
+ * the output: the pair's, then the ones only this mate had. Tags Arachne
+ * computes itself win over input tags of the same name.
+ */
+func appendInputTags(aux []sam.Aux, input_tags *[]sam.Aux, mate_tags *[]sam.Aux) []sam.Aux {
+	if (input_tags == nil || len(*input_tags) == 0) && (mate_tags == nil || len(*mate_tags) == 0) {
+		return aux
+	}
+	written := make(map[sam.Tag]bool, len(aux))
+	for _, a := range aux {
+		written[a.Tag()] = true
+	}
+	for _, tags := range []*[]sam.Aux{input_tags, mate_tags} {
+		if tags == nil {
+			continue
+		}
+		for _, a := range *tags {
+			if !written[a.Tag()] {
+				aux = append(aux, a)
+			}
+		}
+	}
+	return aux
+}
+
+/* Index into FastQRecord.MateTags of R1 or R2 */
+func mateIndex(read1 bool) int {
+	if read1 {
+		return 0
+	}
+	return 1
+}
+
 func (b *BAMWriters) Close() {
 	b.channel <- nil
 	b.done.Lock()
@@ -620,10 +660,21 @@ func BamThread(b *BAMWriters) {
 	b.done.RLock()
 
 	for alignments := <-b.channel; alignments != nil; alignments = <-b.channel {
-		DoDumpToBam(alignments.alignments, b, b.debugTags, alignments.attach_bx)
+		if alignments.overflow {
+			for i := range alignments.reads {
+				if err := b.OverflowBam.AppendUnaligned(&alignments.reads[i]); err != nil {
+					panic(err)
+				}
+			}
+		} else {
+			DoDumpToBam(alignments.alignments, b, b.debugTags, alignments.attach_bx)
+		}
 		ReturnBuffer(alignments.reads)
 	}
 	b.BarcodeSortedBam.Writer.Close()
+	if b.OverflowBam != nil {
+		b.OverflowBam.Writer.Close()
+	}
 	for _, bams := range b.PositionBucketedBams {
 		for _, bam := range bams {
 			bam.Writer.Close()
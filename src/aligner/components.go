@@ -0,0 +1,139 @@
+package aligner
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"arachne/src/optimizer"
+)
+
+/*
+ * Index which molecules each read has an alignment in, and from it link every
+ * candidate molecule to the others its reads could move to. Molecules linked
+ * by shared reads, or by the two mates of a pair, form a component: moves and
+ * molecule move probabilities never reach outside one, so each component can
+ * be optimized on its own. Neighbors and components keep molecule order.
+ */
+func linkMolecules(candidate_molecules []*CandidateMolecule) [][]*CandidateMolecule {
+	molecules_for_read := map[int][]int{}
+	for m, molecule := range candidate_molecules {
+		for _, read_id := range molecule.best_alignment_for_read.IterKeys() {
+			molecules_for_read[read_id] = append(molecules_for_read[read_id], m)
+		}
+	}
+
+	/* Union-find, where the root of a component is its first molecule */
+	parent := make([]int, len(candidate_molecules))
+	for m := range parent {
+		parent[m] = m
+	}
+	find := func(m int) int {
+		for parent[m] != m {
+			parent[m] = parent[parent[m]]
+			m = parent[m]
+		}
+		return m
+	}
+	union := func(a, b int) {
+		a, b = find(a), find(b)
+		if a < b {
+			parent[b] = a
+		} else if b < a {
+			parent[a] = b
+		}
+	}
+
+	seen_from := make([]int, len(candidate_molecules))
+	for m := range seen_from {
+		seen_from[m] = -1
+	}
+	for m, molecule := range candidate_molecules {
+		neighbors := []int{}
+		for _, read_id := range molecule.best_alignment_for_read.IterKeys() {
+			for _, other := range molecules_for_read[read_id] {
+				if other != m && seen_from[other] != m {
+					seen_from[other] = m
+					neighbors = append(neighbors, other)
+					union(m, other)
+				}
+			}
+			mate_id := molecule.best_alignment_for_read.Get(read_id).mate_id
+			if mate_molecules := molecules_for_read[mate_id]; len(mate_molecules) > 0 {
+				union(m, mate_molecules[0])
+			}
+		}
+		sort.Ints(neighbors)
+		molecule.neighbors = make([]*CandidateMolecule, len(neighbors))
+		for i, other := range neighbors {
+			molecule.neighbors[i] = candidate_molecules[other]
+		}
+	}
+
+	components := [][]*CandidateMolecule{}
+	component_for_root := map[int]int{}
+	for m, molecule := range candidate_molecules {
+		root := find(m)
+		c, has := component_for_root[root]
+		if !has {
+			c = len(components)
+			component_for_root[root] = c
+			components = append(components, nil)
+		}
+		components[c] = append(components[c], molecule)
+	}
+	return components
+}
+
+/*
+ * Settings to optimize a component with. Each component draws its own random
+ * numbers, seeded from its first molecule, whichever thread runs it.
+ */
+func componentSettings(settings optimizer.Settings, component []*CandidateMolecule) optimizer.Settings {
+	settings.Seed += int64(component[0].id)
+	return settings
+}
+
+/*
+ * Optimize each component of a barcode's molecules on its own and add up the
+ * molecule move probabilities its MAPQs need, running up to
+ * config.component_threads components at once.
+ */
+func optimizeComponents(components [][]*CandidateMolecule, template Optimizer, config *RFAConfig) {
+	optimizeComponent := func(component []*CandidateMolecule) {
+		o := template
+		o.candidate_molecules = component
+		var model optimizer.Optimizable = o
+		if config.optimizer_settings.Strategy == "exact" && len(component) <= config.optimizer_settings.ExactMaxParts {
+			model = newExactModel(o)
+		}
+		componentSettings(config.optimizer_settings, component).ForSize(len(component)).Optimize(model)
+		if *debugPrintMove {
+			fmt.Println("NOW TESTING MAPQS")
+		}
+		moleculeMapqProbabilitySums(component, o.log_unpaired_probability, o.model)
+	}
+
+	if config.component_threads <= 1 || len(components) <= 1 {
+		for _, component := range components {
+			optimizeComponent(component)
+		}
+		return
+	}
+	queue := make(chan []*CandidateMolecule)
+	var wg sync.WaitGroup
+	for i := 0; i < min(config.component_threads, len(components)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for component := range queue {
+				optimizeComponent(component)
+			}
+		}()
+	}
+	for _, component := range components {
+		queue <- component
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,229 @@
+package aligner
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"arachne/src/optimizer"
+)
+
+/* Settings the scoring functions read from the command line */
+func setTestArgs() {
+	penalty := -4.0
+	off := false
+	improper_pair_penalty = &penalty
+	debugPrintMove = &off
+	DEBUG = &off
+}
+
+/*
+ * A barcode whose reads come from several groups of repeated regions, each
+ * region copied on chr1, chr2 and chr3. Reads of a group can align to more
+ * than one copy, so a group's molecules share reads with each other but never
+ * with another group's: every group is its own component.
+ */
+func repeatBarcodeFixture(seed int64) [][]*Alignment {
+	random := rand.New(rand.NewSource(seed))
+	alignments := [][]*Alignment{}
+	next_id := 0
+	newAlignment := func(read_id int, contig string, pos int64, reversed bool, mismatches int) *Alignment {
+		locs := make([]int, mismatches)
+		for i := range locs {
+			locs[i] = int(pos) + random.Intn(100)
+		}
+		aln := &Alignment{
+			id:           next_id,
+			read_id:      read_id,
+			mate_id:      read_id ^ 1,
+			read1:        read_id%2 == 0,
+			contig:       contig,
+			pos:          pos,
+			aend:         pos + 100,
+			reversed:     reversed,
+			score:        100 - 5*mismatches,
+			mismatches:   mismatches,
+			mismatchLocs: locs,
+			molecule_id:  -1,
+			mapq_data:    &MapQData{},
+		}
+		aln.log_alignment_probability = scoreAlignment(aln, nil, 0.0) - *improper_pair_penalty
+		next_id++
+		return aln
+	}
+
+	for group := 0; group < 4; group++ {
+		base := int64(group+1) * 1000000
+		for pair := 0; pair < 30; pair++ {
+			read_id := len(alignments)
+			name := fmt.Sprintf("g%dp%d", group, pair)
+			offset := int64(random.Intn(20000))
+			/* Most pairs come from the chr1 copy, and most also align to another */
+			contigs := []string{"chr1", "chr2", "chr3"}
+			if random.Intn(3) == 0 {
+				random.Shuffle(len(contigs), func(i, j int) { contigs[i], contigs[j] = contigs[j], contigs[i] })
+			}
+			mates := [2][]*Alignment{}
+			for mate := 0; mate < 2; mate++ {
+				pos := base + offset + int64(250*mate)
+				mates[mate] = append(mates[mate], newAlignment(read_id+mate, contigs[0], pos, mate == 1, random.Intn(2)))
+				for _, away := range contigs[1:] {
+					if random.Intn(2) == 0 {
+						mates[mate] = append(mates[mate], newAlignment(read_id+mate, away, pos, mate == 1, random.Intn(3)))
+					}
+				}
+			}
+			for mate := 0; mate < 2; mate++ {
+				for _, aln := range mates[mate] {
+					aln.read_name = &name
+				}
+				alignments = append(alignments, mates[mate])
+			}
+		}
+	}
+	return alignments
+}
+
+/*
+ * What the old optimizer did: every molecule of the barcode a possible sink
+ * for every other, optimized and scored all together. Annealing isn't
+ * compared against it, as each component anneals with its own seed.
+ */
+func placeReadsInAllMolecules(alignments [][]*Alignment, positions [][]*Alignment, config *RFAConfig) int {
+	candidate_molecules := inferMolecules(positions, &config.model)
+	markBestAlignmentForReadInMolecule(candidate_molecules)
+	candidate_molecules = scrapMolecules(candidate_molecules)
+	setMoleculeDifferences(candidate_molecules, false)
+	components := len(linkMolecules(candidate_molecules))
+
+	for _, molecule := range candidate_molecules {
+		molecule.neighbors = nil
+		for _, other := range candidate_molecules {
+			if other != molecule {
+				molecule.neighbors = append(molecule.neighbors, other)
+			}
+		}
+	}
+	o := Optimizer{
+		candidate_molecules:      candidate_molecules,
+		alignments:               alignments,
+		log_unpaired_probability: config.improper_penalty,
+		model:                    &config.model,
+	}
+	var model optimizer.Optimizable = o
+	if config.optimizer_settings.Strategy == "exact" && len(candidate_molecules) <= config.optimizer_settings.ExactMaxParts {
+		model = newExactModel(o)
+	}
+	config.optimizer_settings.ForSize(len(candidate_molecules)).Optimize(model)
+	moleculeMapqProbabilitySums(candidate_molecules, o.log_unpaired_probability, o.model)
+	return components
+}
+
+type placement struct {
+	active      bool
+	molecule_id int
+	move_sum    float64
+}
+
+func placements(alignments [][]*Alignment) map[int]placement {
+	placed := map[int]placement{}
+	for _, alignmentArray := range alignments {
+		for _, aln := range alignmentArray {
+			placed[aln.id] = placement{aln.active, aln.molecule_id, aln.sum_move_probability_change}
+		}
+	}
+	return placed
+}
+
+func TestComponentsMatchAllMolecules(t *testing.T) {
+	setTestArgs()
+	for _, strategy := range []string{"greedy", "exact"} {
+		for _, early_stop := range []bool{true, false} {
+			for _, threads := range []int{1, 4} {
+				config := &RFAConfig{
+					improper_penalty:   -4,
+					optimizer_settings: DefaultOptimizerSettings,
+					component_threads:  threads,
+					model:              DefaultMoleculeModel,
+				}
+				config.optimizer_settings.Strategy = strategy
+				/* Big enough that the whole barcode is solved exactly too */
+				config.optimizer_settings.ExactMaxParts = 64
+				config.optimizer_settings.EarlyStop = early_stop
+
+				for seed := int64(1); seed <= 5; seed++ {
+					old_alignments := repeatBarcodeFixture(seed)
+					positions := tagBestAlignments(old_alignments)
+					before := placements(old_alignments)
+					components := placeReadsInAllMolecules(old_alignments, positions, config)
+					want := placements(old_alignments)
+					if components < 2 {
+						t.Fatalf("seed %d: fixture has %d components, want several", seed, components)
+					}
+
+					new_alignments := repeatBarcodeFixture(seed)
+					placeReadsInMolecules(new_alignments, tagBestAlignments(new_alignments), "", config)
+					got := placements(new_alignments)
+
+					moved := 0
+					for id, p := range want {
+						if p.active != before[id].active {
+							moved++
+						}
+						if got[id] != p {
+							t.Errorf("%s, early stop %v, %d threads, seed %d: alignment %d placed %+v, want %+v", strategy, early_stop, threads, seed, id, got[id], p)
+						}
+					}
+					if moved == 0 {
+						t.Errorf("%s, seed %d: the optimizer moved no reads, so the fixture tests nothing", strategy, seed)
+					}
+				}
+			}
+		}
+	}
+}
+
+/*
+ * Components anneal with seeds of their own, and so their placements don't
+ * depend on which thread anneals which component
+ */
+func TestComponentsAnnealIndependentOfThreads(t *testing.T) {
+	setTestArgs()
+	for seed := int64(1); seed <= 5; seed++ {
+		alignments := repeatBarcodeFixture(seed)
+		candidate_molecules := inferMolecules(tagBestAlignments(alignments), &DefaultMoleculeModel)
+		markBestAlignmentForReadInMolecule(candidate_molecules)
+		candidate_molecules = scrapMolecules(candidate_molecules)
+		seeds := map[int64]bool{}
+		for _, component := range linkMolecules(candidate_molecules) {
+			seeds[componentSettings(DefaultOptimizerSettings, component).Seed] = true
+		}
+		if len(seeds) < 2 {
+			t.Errorf("seed %d: the fixture's components all anneal with one seed", seed)
+		}
+
+		var want map[int]placement
+		for _, threads := range []int{1, 4, 1} {
+			config := &RFAConfig{
+				improper_penalty:   -4,
+				optimizer_settings: DefaultOptimizerSettings,
+				component_threads:  threads,
+				model:              DefaultMoleculeModel,
+			}
+			config.optimizer_settings.Strategy = "anneal"
+
+			alignments := repeatBarcodeFixture(seed)
+			placeReadsInMolecules(alignments, tagBestAlignments(alignments), "", config)
+			got := placements(alignments)
+			if want == nil {
+				want = got
+				continue
+			}
+			for id, p := range want {
+				if got[id] != p {
+					t.Errorf("%d threads, seed %d: alignment %d placed %+v, want %+v", threads, seed, id, got[id], p)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package aligner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	"arachne/src/fastqreader"
+	"arachne/src/gobwa"
+)
+
+const (
+	/* The estimation pass reads ahead at most this many read pairs for each
+	 * barcode it samples, and this many in all. All of them stay in memory
+	 * until the main loop replays them.
+	 */
+	estimateReadPairsPerBarcode = 1000
+	estimateMaxReadPairs        = 2000000
+	/* Fewest active molecules the estimates are trusted from */
+	minEstimateMolecules = 20
+)
+
+/* A barcode set read ahead by the estimation pass, for the main loop to replay */
+type prefetchedSet struct {
+	reads []fastqreader.FastQRecord
+	full  bool
+}
+
+/*
+ * Read ahead until there are sample_barcodes whole barcodes that RFA would
+ * run on, or estimateReadPairsPerBarcode read pairs for each of them (up to
+ * estimateMaxReadPairs). Every set read is returned for the main loop, along
+ * with the sample.
+ */
+func prefetchSample(fastq *fastqreader.FastQReader, sample_barcodes int, config *RFAConfig) ([]prefetchedSet, [][]fastqreader.FastQRecord, error) {
+	var sets []prefetchedSet
+	var sample [][]fastqreader.FastQRecord
+	max_read_pairs := min(estimateMaxReadPairs, sample_barcodes*estimateReadPairsPerBarcode)
+	read_pairs := 0
+	var space []fastqreader.FastQRecord
+	for len(sample) < sample_barcodes && read_pairs < max_read_pairs {
+		reads, err, full := fastq.ReadBarcodeSet(&space)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		/* Read into one buffer and keep a copy of just the right size, as
+		 * most sets are small
+		 */
+		space = reads
+		reads = slices.Clone(reads)
+		sets = append(sets, prefetchedSet{reads: reads, full: full})
+		read_pairs += len(reads)
+		if full && worthRunningRFA(reads, true, config.min_rfa_reads) {
+			sample = append(sample, reads)
+		}
+	}
+	return sets, sample, nil
+}
+
+/*
+ * The active molecules found in a sample of barcodes
+ */
+type moleculeSample struct {
+	barcodes int
+	/* Span from first to last read, reads placed, and read pairs placed, of each molecule */
+	lengths   []float64
+	reads     []float64
+	fragments []float64
+	/* Span over read pairs less one, for molecules with at least two read pairs */
+	spacings []float64
+	/* Reads in active molecules, and all reads */
+	placed int
+	total  int
+
+	lock sync.Mutex
+}
+
+/*
+ * Run RFA with the current model on each barcode of the sample, without
+ * writing anything, and measure the active molecules it finds
+ */
+func measureMolecules(sample [][]fastqreader.FastQRecord, ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, config *RFAConfig, threads int) *moleculeSample {
+	measured := &moleculeSample{barcodes: len(sample)}
+	queue := make(chan []fastqreader.FastQRecord)
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, threads); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for reads := range queue {
+				measured.add(moleculesForBarcode(reads, ref, settings, config), len(reads), &config.model)
+			}
+		}()
+	}
+	for _, reads := range sample {
+		queue <- reads
+	}
+	close(queue)
+	wg.Wait()
+	return measured
+}
+
+func moleculesForBarcode(reads []fastqreader.FastQRecord, ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, config *RFAConfig) []*CandidateMolecule {
+	arena := gobwa.NewArena()
+	defer arena.Free()
+	barcode_chains, barcode := GetChains(ref, settings, reads, arena, 25)
+	alignments, _ := GetAlignments(ref, settings, barcode_chains, 17, arena)
+	positions := tagBestAlignments(alignments)
+	optimized := placeReadsInMolecules(alignments, positions, barcode, config)
+	setMoleculeConfidences(optimized.candidate_molecules)
+	return optimized.candidate_molecules
+}
+
+func (s *moleculeSample) add(molecules []*CandidateMolecule, read_pairs int, model *MoleculeModel) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.total += 2 * read_pairs
+	for _, molecule := range molecules {
+		if !isMoleculeActive(molecule, model) {
+			continue
+		}
+		smallest, biggest := int64(math.MaxInt64), int64(-1)
+		fragments := map[int]bool{}
+		for _, alignment := range molecule.active_alignments.Iter() {
+			smallest = min(smallest, alignment.pos)
+			biggest = max(biggest, alignment.pos)
+			fragments[alignment.read_id/2] = true
+		}
+		s.placed += molecule.active_alignments.Len()
+		s.lengths = append(s.lengths, float64(biggest-smallest))
+		s.reads = append(s.reads, float64(molecule.active_alignments.Len()))
+		s.fragments = append(s.fragments, float64(len(fragments)))
+		if len(fragments) > 1 {
+			s.spacings = append(s.spacings, float64(biggest-smallest)/float64(len(fragments)-1))
+		}
+	}
+}
+
+/* The value below which the given fraction of values fall */
+func quantile(values []float64, fraction float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(fraction*float64(len(sorted)-1))]
+}
+
+/*
+ * A model fitted to the sample, keeping base's other parameters, or false if
+ * the sample has too few molecules to go by
+ */
+func (s *moleculeSample) estimate(base MoleculeModel) (MoleculeModel, bool) {
+	if len(s.spacings) < minEstimateMolecules {
+		return base, false
+	}
+	model := base
+	fragments := quantile(s.fragments, 0.5)
+	/* Read pairs land about uniformly along a molecule, so the gaps between them
+	 * are about exponential. Allow for the gaps of a typical molecule to all fit
+	 * under MaxGap 99% of the time, even where reads are sparse.
+	 */
+	model.MaxGap = max(1000, int64(quantile(s.spacings, 0.9)*math.Log(100*max(1, fragments-1))))
+	/* A quarter of a typical molecule's reads still makes a molecule */
+	model.MinReads = max(2, int(math.Round(quantile(s.reads, 0.5)/4)))
+	/* Reads miss about one spacing at each end of a molecule */
+	model.Padding = math.Round(2 * quantile(s.spacings, 0.5))
+	model.SingletonProb = min(0.5, max(0.001, 1-float64(s.placed)/float64(s.total)))
+	return model, true
+}
+
+/*
+ * Print the molecule model used and write it, with what the sample measured
+ * if there was one, to molecule_model.tsv in the output directory
+ */
+func writeMoleculeModel(dir string, model *MoleculeModel, measured *moleculeSample) error {
+	print(fmt.Sprintf("Molecule model: gap %d, more than %d reads, confidence %g, singleton probability %g, padding %g, costs %g/%g\n",
+		model.MaxGap, model.MinReads, model.MinConfidence, model.SingletonProb, model.Padding, model.MoleculeCost, model.ActiveReadCost))
+
+	file, err := os.Create(dir + "/molecule_model.tsv")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "parameter\tvalue\n")
+	fmt.Fprintf(w, "max_gap\t%d\n", model.MaxGap)
+	fmt.Fprintf(w, "min_reads\t%d\n", model.MinReads)
+	fmt.Fprintf(w, "min_confidence\t%g\n", model.MinConfidence)
+	fmt.Fprintf(w, "singleton_prob\t%g\n", model.SingletonProb)
+	fmt.Fprintf(w, "padding\t%g\n", model.Padding)
+	fmt.Fprintf(w, "molecule_cost\t%g\n", model.MoleculeCost)
+	fmt.Fprintf(w, "active_read_cost\t%g\n", model.ActiveReadCost)
+	if measured != nil {
+		fmt.Fprintf(w, "sampled_barcodes\t%d\n", measured.barcodes)
+		fmt.Fprintf(w, "sampled_molecules\t%d\n", len(measured.lengths))
+		fmt.Fprintf(w, "median_molecule_length\t%g\n", quantile(measured.lengths, 0.5))
+		fmt.Fprintf(w, "median_reads_per_molecule\t%g\n", quantile(measured.reads, 0.5))
+		fmt.Fprintf(w, "median_read_pair_spacing\t%g\n", quantile(measured.spacings, 0.5))
+	}
+	err = w.Flush()
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package aligner
+
+import (
+	"sort"
+
+	"arachne/src/optimizer"
+)
+
+/*
+ * The exact optimizer chooses which candidate molecules to keep. Given those,
+ * each read pair goes where it scores best: both mates in one kept molecule as
+ * a proper pair, or each mate on its own at the cost of the improper pair
+ * penalty. A state is scored the way fastScore scores moves between states.
+ */
+type exactModel struct {
+	Optimizer
+	pairs []exactReadPair
+}
+
+type exactReadPair struct {
+	read_ids [2]int
+	/* Best alignment of each mate in each molecule, nil where it has none */
+	mates [2][]*Alignment
+	/* Does the mate have an alignment in any molecule, so that it must be placed? */
+	placed [2]bool
+}
+
+func newExactModel(o Optimizer) *exactModel {
+	by_pair := map[int]*exactReadPair{}
+	for m, molecule := range o.candidate_molecules {
+		for _, read_id := range molecule.best_alignment_for_read.IterKeys() {
+			pair, has := by_pair[read_id/2]
+			if !has {
+				pair = &exactReadPair{read_ids: [2]int{read_id / 2 * 2, read_id/2*2 + 1}}
+				pair.mates[0] = make([]*Alignment, len(o.candidate_molecules))
+				pair.mates[1] = make([]*Alignment, len(o.candidate_molecules))
+				by_pair[read_id/2] = pair
+			}
+			pair.mates[read_id%2][m] = molecule.best_alignment_for_read.Get(read_id)
+			pair.placed[read_id%2] = true
+		}
+	}
+
+	model := &exactModel{Optimizer: o}
+	for _, pair := range by_pair {
+		model.pairs = append(model.pairs, *pair)
+	}
+	sort.Slice(model.pairs, func(a, b int) bool { return model.pairs[a].read_ids[0] < model.pairs[b].read_ids[0] })
+	return model
+}
+
+/*
+ * Best score of a read pair using only allowed molecules, and the molecule
+ * each mate goes to (-1 for a mate that has no alignments)
+ */
+func (p *exactReadPair) best(allowed []bool, log_unpaired_probability float64) (float64, [2]int, bool) {
+	where := [2]int{-1, -1}
+	score := 0.0
+	for mate := 0; mate < 2; mate++ {
+		if !p.placed[mate] {
+			continue
+		}
+		for m, aln := range p.mates[mate] {
+			if aln != nil && allowed[m] && (where[mate] < 0 || aln.log_alignment_probability > p.mates[mate][where[mate]].log_alignment_probability) {
+				where[mate] = m
+			}
+		}
+		if where[mate] < 0 {
+			return 0, where, false
+		}
+		score += p.mates[mate][where[mate]].log_alignment_probability + log_unpaired_probability/2.0
+	}
+	if p.placed[0] && p.placed[1] {
+		for m := range allowed {
+			read1, read2 := p.mates[0][m], p.mates[1][m]
+			if allowed[m] && read1 != nil && read2 != nil && isPair(read1, read2) {
+				if paired := read1.log_alignment_probability + read2.log_alignment_probability; paired > score {
+					score = paired
+					where = [2]int{m, m}
+				}
+			}
+		}
+	}
+	return score, where, true
+}
+
+func (e *exactModel) Parts() int {
+	return len(e.candidate_molecules)
+}
+
+/* Molecules only ever cost, so the reads alone bound the score */
+func (e *exactModel) Bound(allowed []bool) (float64, bool) {
+	total := 0.0
+	for i := range e.pairs {
+		score, _, ok := e.pairs[i].best(allowed, e.log_unpaired_probability)
+		if !ok {
+			return 0, false
+		}
+		total += score
+	}
+	return total, true
+}
+
+func (e *exactModel) Score(keep []bool) (float64, bool) {
+	total := 0.0
+	active := make([]int, len(e.candidate_molecules))
+	for i := range e.pairs {
+		score, where, ok := e.pairs[i].best(keep, e.log_unpaired_probability)
+		if !ok {
+			return 0, false
+		}
+		total += score
+		for mate := 0; mate < 2; mate++ {
+			if where[mate] >= 0 {
+				active[where[mate]]++
+			}
+		}
+	}
+	for m, molecule := range e.candidate_molecules {
+		if active[m] > 0 {
+			total += e.model.MoleculeCost
+		}
+		if isActiveMolecule(molecule, active[m]-molecule.active_alignments.Len(), e.model) {
+			total += float64(molecule.best_alignment_for_read.Len()) * e.model.ActiveReadCost
+		}
+	}
+	return total, true
+}
+
+func (e *exactModel) Apply(keep []bool) optimizer.Optimizable {
+	for i := range e.pairs {
+		_, where, _ := e.pairs[i].best(keep, e.log_unpaired_probability)
+		for mate := 0; mate < 2; mate++ {
+			if where[mate] >= 0 {
+				e.placeRead(e.pairs[i].read_ids[mate], e.candidate_molecules[where[mate]], e.pairs[i].mates[mate][where[mate]])
+			}
+		}
+	}
+	return e.Optimizer
+}
+
+/* Make aln the read's active alignment, in the given molecule */
+func (e *exactModel) placeRead(read_id int, sink *CandidateMolecule, aln *Alignment) {
+	for _, source := range e.candidate_molecules {
+		if current := source.active_alignments.Get(read_id); current != nil {
+			if current != aln {
+				acceptMove(Move{source: source, sink: sink, toDelete: []int{read_id}, toSet: []*Alignment{aln}})
+			}
+			return
+		}
+	}
+	for _, mismatchLoc := range aln.mismatchLocs {
+		sink.mismatchLocs[mismatchLoc]++
+	}
+	sink.active_alignments.Set(read_id, aln)
+	aln.active = true
+}
@@ -0,0 +1,60 @@
+package aligner
+
+import (
+	"fmt"
+)
+
+/*
+ * Parameters of the molecule model that RFA places reads with. The defaults
+ * were tuned for 10X GEMs; the longer, sparser molecules of stLFR and
+ * haplotagging are better served by others, which --estimate-model can
+ * measure from the data.
+ */
+type MoleculeModel struct {
+	/* Alignments further apart than this start a new candidate molecule */
+	MaxGap int64
+	/* An active molecule has more than MinReads reads placed in it... */
+	MinReads int
+	/* ...and at least MinConfidence of the reads that could be */
+	MinConfidence float64
+	/* Probability of a read being a singleton, outside any molecule */
+	SingletonProb float64
+	/* Length added to each active molecule's span for its unsequenced ends */
+	Padding float64
+	/* Log probability of each molecule that has reads placed in it */
+	MoleculeCost float64
+	/* Log probability of an active molecule, per read that could be placed in it */
+	ActiveReadCost float64
+}
+
+var DefaultMoleculeModel = MoleculeModel{
+	MaxGap:         50000,
+	MinReads:       4,
+	MinConfidence:  0.1,
+	SingletonProb:  0.05,
+	Padding:        1000,
+	MoleculeCost:   -3,
+	ActiveReadCost: -0.5,
+}
+
+func (m *MoleculeModel) Check() error {
+	if m.MaxGap < 1 {
+		return fmt.Errorf("the molecule gap must be at least 1")
+	}
+	if m.MinReads < 0 {
+		return fmt.Errorf("the minimum reads per molecule can't be negative")
+	}
+	if m.MinConfidence < 0 || m.MinConfidence > 1 {
+		return fmt.Errorf("the minimum molecule confidence must be between 0 and 1")
+	}
+	if m.SingletonProb <= 0 || m.SingletonProb > 1 {
+		return fmt.Errorf("the singleton probability must be greater than 0 and at most 1")
+	}
+	if m.Padding < 0 {
+		return fmt.Errorf("the molecule padding can't be negative")
+	}
+	if m.MoleculeCost > 0 || m.ActiveReadCost > 0 {
+		return fmt.Errorf("molecule costs are log probabilities, so can't be positive")
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package aligner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"arachne/src/fastqreader"
+	"arachne/src/gobwa"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/*
+ * What to do with a barcode that has more read pairs than fit in one work
+ * unit (--max-barcode-reads)
+ */
+type OversizedPolicy int
+
+const (
+	/* Align it a work unit at a time as ordinary pairs, without RFA */
+	OversizedSkip OversizedPolicy = iota
+	/* Map it once, cut it into groups of reads close together on the genome
+	 * and run RFA on each group on its own
+	 */
+	OversizedSplit
+	/* Leave it unaligned in overflow/unaligned.bam, for handling separately */
+	OversizedOverflow
+)
+
+var oversizedPolicyNames = []string{"skip", "split", "overflow"}
+
+func (p OversizedPolicy) String() string {
+	return oversizedPolicyNames[p]
+}
+
+func ParseOversizedPolicy(name string) (OversizedPolicy, error) {
+	for i, policy := range oversizedPolicyNames {
+		if strings.ToLower(name) == policy {
+			return OversizedPolicy(i), nil
+		}
+	}
+	return OversizedSkip, fmt.Errorf("unknown policy for oversized barcodes %q (expected skip, split or overflow)", name)
+}
+
+/*
+ * Reads of one oversized barcode further apart than this (or on different
+ * contigs) can't come from the same molecule, so "split" may cut between them
+ */
+const splitLocalityGap = 100000
+
+/*
+ * Tally of the barcodes that went over the cap and what became of them
+ */
+type OversizedStats struct {
+	Policy    OversizedPolicy
+	MaxReads  int
+	Barcodes  int
+	ReadPairs int
+	/* With "split": RFA groups made, and read pairs that didn't map on the first pass */
+	Groups   int
+	Unplaced int
+
+	lock sync.Mutex
+}
+
+func (s *OversizedStats) add(barcodes, readPairs, groups, unplaced int) {
+	s.lock.Lock()
+	s.Barcodes += barcodes
+	s.ReadPairs += readPairs
+	s.Groups += groups
+	s.Unplaced += unplaced
+	s.lock.Unlock()
+}
+
+/* Print the tally and write it to oversized_barcodes.tsv in the output directory */
+func (s *OversizedStats) Write(dir string) error {
+	print(fmt.Sprintf("Barcodes over %d read pairs: %d (%d read pairs), handled with policy %q\n", s.MaxReads, s.Barcodes, s.ReadPairs, s.Policy))
+	if s.Policy == OversizedSplit && s.Barcodes > 0 {
+		print(fmt.Sprintf("Split into %d groups by genomic locality; %d read pairs didn't map on the first pass\n", s.Groups, s.Unplaced))
+	}
+
+	file, err := os.Create(dir + "/oversized_barcodes.tsv")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "policy\tmax_barcode_reads\tbarcodes\tread_pairs\tsplit_groups\tunplaced_read_pairs\n")
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", s.Policy, s.MaxReads, s.Barcodes, s.ReadPairs, s.Groups, s.Unplaced)
+	err = w.Flush()
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/* Read pairs of an oversized barcode with the hits BWA found for them */
+type localityGroup struct {
+	reads []fastqreader.FastQRecord
+	hits  [][2][]gobwa.EasyAlignment
+}
+
+/*
+ * Cut an oversized barcode into groups of at most maxReads read pairs that lie
+ * close together on the genome, going by the best hit BWA finds for each pair.
+ * Pairs that don't map anywhere are returned separately. The hits are kept for
+ * RFA so that no pair is mapped twice; they live as long as the arena.
+ */
+func splitByLocality(ref *gobwa.GoBwaReference, settings *gobwa.GoBwaSettings, reads []fastqreader.FastQRecord, maxReads int, arena *gobwa.Arena) ([]localityGroup, localityGroup) {
+	type placedRead struct {
+		contig string
+		pos    int64
+		index  int
+	}
+	placed := make([]placedRead, 0, len(reads))
+	var unplaced localityGroup
+
+	hits := mapReadPairs(ref, settings, reads, arena, 25)
+	for i := range reads {
+		var best *gobwa.EasyAlignment
+		for _, mate_hits := range hits[i] {
+			for j := range mate_hits {
+				if best == nil || mate_hits[j].Score > best.Score {
+					best = &mate_hits[j]
+				}
+			}
+		}
+		if best == nil {
+			unplaced.reads = append(unplaced.reads, reads[i])
+			unplaced.hits = append(unplaced.hits, hits[i])
+		} else {
+			placed = append(placed, placedRead{best.Contig, best.Offset, i})
+		}
+	}
+
+	sort.Slice(placed, func(a, b int) bool {
+		if placed[a].contig != placed[b].contig {
+			return placed[a].contig < placed[b].contig
+		}
+		return placed[a].pos < placed[b].pos
+	})
+
+	var groups []localityGroup
+	var group localityGroup
+	for i, read := range placed {
+		if i > 0 && (read.contig != placed[i-1].contig || read.pos-placed[i-1].pos > splitLocalityGap || len(group.reads) == maxReads) {
+			groups = append(groups, group)
+			group = localityGroup{}
+		}
+		/* Each group gets its own array, as they go back to the buffer pool separately */
+		group.reads = append(group.reads, reads[read.index])
+		group.hits = append(group.hits, hits[read.index])
+	}
+	if len(group.reads) > 0 {
+		groups = append(groups, group)
+	}
+	return groups, unplaced
+}
+
+/*
+ * Write a read pair as unaligned BAM records, keeping its barcode, read group
+ * and tags so that Arachne can read it back in
+ */
+func (b *BAMWriter) AppendUnaligned(read *fastqreader.FastQRecord) error {
+	for mate := 1; mate <= 2; mate++ {
+		seq, qual := read.Read1, read.ReadQual1
+		flags := sam.Paired | sam.Unmapped | sam.MateUnmapped | sam.Read1
+		if mate == 2 {
+			seq, qual = read.Read2, read.ReadQual2
+			flags = sam.Paired | sam.Unmapped | sam.MateUnmapped | sam.Read2
+		}
+		aux := []sam.Aux{}
+		if len(read.Barcode) > 0 {
+			valid := 0
+			if read.Valid {
+				valid = 1
+			}
+			aux = append(aux, sam.Aux(auxify_string([]byte("BX"), read.Barcode)), sam.Aux(auxify_int("VX", valid)))
+		}
+		if read.ReadGroupId != "" {
+			aux = append(aux, sam.Aux(auxify_string([]byte("RG"), []byte(read.ReadGroupId))))
+		}
+		aux = appendInputTags(aux, &read.Tags, &read.MateTags[mate-1])
+
+		record, err := sam.NewRecord(read.ReadInfo, nil, nil, -1, -1, 0, 0, nil, seq, fixQual(qual), aux)
+		if err != nil {
+			return err
+		}
+		record.Flags = flags
+		if err := b.Writer.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Run RFA on each locality group of an oversized barcode on its own. Pairs
+ * that didn't map on the first pass are written as ordinary unmapped pairs.
+ */
+func SplitOversizedBarcode(work *WorkUnit,
+	bams *BAMWriters,
+	ref *gobwa.GoBwaReference,
+	settings *gobwa.GoBwaSettings,
+	config *RFAConfig,
+	stats *RFAStats) {
+
+	arena := gobwa.NewArena()
+	groups, unplaced := splitByLocality(ref, settings, work.reads, config.oversized.MaxReads, arena)
+	config.oversized.add(0, 0, len(groups), len(unplaced.reads))
+	for _, group := range groups {
+		DoRFAForOneBarcode(&WorkUnit{reads: group.reads, barcodenum: work.barcodenum, unique_barcode: true, hits: group.hits}, bams, ref, settings, config, stats, group.reads)
+	}
+	if len(unplaced.reads) > 0 {
+		DoRFAForOneBarcode(&WorkUnit{reads: unplaced.reads, barcodenum: work.barcodenum, hits: unplaced.hits}, bams, ref, settings, config, stats, unplaced.reads)
+	}
+	arena.Free()
+}
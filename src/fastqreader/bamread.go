@@ -0,0 +1,248 @@
+package fastqreader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	bam "github.com/biogo/hts/bam"
+	sam "github.com/biogo/hts/sam"
+)
+
+var (
+	bamMagic  = []byte("BAM\x01")
+	cramMagic = []byte("CRAM")
+)
+
+/*
+ * Produces read pairs from something other than a pair of FASTQ streams.
+ * When FastQReader.Records is set, ReadOneLine (and so ReadBarcodeSet)
+ * pulls from it instead of R1Buffer/R2Buffer.
+ */
+type RecordSource interface {
+	ReadRecord(result *FastQRecord) error
+	Close() error
+}
+
+/*
+ * Reads unaligned BAM (uBAM) where the two reads of a pair are adjacent,
+ * i.e. queryname- or barcode-grouped output of a basecaller or of
+ * "samtools import". Barcodes come from BX/VX, or from CB (corrected, so
+ * valid) and RX (raw, so invalid) when there is no BX. A BX without a VX is
+ * taken to be corrected, as in 10x Genomics' BAMs. Every other aux tag is
+ * kept, in FastQRecord.Tags if both reads have it and in MateTags if not.
+ */
+type UnalignedBamSource struct {
+	reader *bam.Reader
+	closer io.Closer
+	/* Number of BAM records consumed, for error messages */
+	Record int
+}
+
+var (
+	bxTag = sam.NewTag("BX")
+	vxTag = sam.NewTag("VX")
+	cbTag = sam.NewTag("CB")
+	rxTag = sam.NewTag("RX")
+)
+
+/* Pull the next primary record, skipping secondary and supplementary ones */
+func (u *UnalignedBamSource) next() (*sam.Record, error) {
+	for {
+		rec, err := u.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		u.Record++
+		if rec.Flags&(sam.Secondary|sam.Supplementary) == 0 {
+			return rec, nil
+		}
+	}
+}
+
+/* Convert a BAM sequence/quality back to the orientation it was sequenced in, as FASTQ text */
+func bamReadBases(rec *sam.Record) ([]byte, []byte) {
+	seq := rec.Seq.Expand()
+	qual := make([]byte, len(rec.Qual))
+	for i, q := range rec.Qual {
+		if q == 0xff {
+			/* quality absent */
+			q = 0
+		}
+		qual[i] = q + 33
+	}
+	if len(qual) != len(seq) {
+		qual = bytes.Repeat([]byte{'!'}, len(seq))
+	}
+	if rec.Flags&sam.Reverse != 0 {
+		for i, j := 0, len(seq)-1; i < j; i, j = i+1, j-1 {
+			seq[i], seq[j] = seq[j], seq[i]
+			qual[i], qual[j] = qual[j], qual[i]
+		}
+		for i := range seq {
+			seq[i] = baseComplement(seq[i])
+		}
+	}
+	return seq, qual
+}
+
+func baseComplement(b byte) byte {
+	switch b {
+	case 'A':
+		return 'T'
+	case 'C':
+		return 'G'
+	case 'G':
+		return 'C'
+	case 'T':
+		return 'A'
+	default:
+		return 'N'
+	}
+}
+
+/* The barcode and its validity from a record's aux fields, and every other aux field */
+func bamBarcode(rec *sam.Record) ([]byte, bool, []sam.Aux) {
+	var bx, vx, cb, rx sam.Aux
+	var tags []sam.Aux
+	for _, aux := range rec.AuxFields {
+		switch aux.Tag() {
+		case bxTag:
+			bx = aux
+		case vxTag:
+			vx = aux
+		case cbTag:
+			cb = aux
+			tags = append(tags, aux)
+		case rxTag:
+			rx = aux
+			tags = append(tags, aux)
+		default:
+			tags = append(tags, aux)
+		}
+	}
+
+	switch {
+	case bx != nil:
+		return []byte(fmt.Sprint(bx.Value())), vx == nil || fmt.Sprint(vx.Value()) != "0", tags
+	case cb != nil:
+		return []byte(fmt.Sprint(cb.Value())), true, tags
+	case rx != nil:
+		return []byte(fmt.Sprint(rx.Value())), false, tags
+	}
+	return []byte(""), false, tags
+}
+
+func (u *UnalignedBamSource) ReadRecord(result *FastQRecord) error {
+	first, err := u.next()
+	if err != nil {
+		return err
+	}
+	second, err := u.next()
+	if err == io.EOF {
+		return &ParseError{"BAM", u.Record, fmt.Sprintf("read %q has no mate", first.Name)}
+	}
+	if err != nil {
+		return err
+	}
+	if first.Name != second.Name {
+		return &ParseError{"BAM", u.Record, fmt.Sprintf("read names differ: %q then %q (is the BAM grouped by read name?)", first.Name, second.Name)}
+	}
+	if first.Flags&sam.Read2 != 0 || second.Flags&sam.Read1 != 0 {
+		first, second = second, first
+	}
+
+	result.ReadInfo = first.Name
+	result.ReadGroupId = ""
+	result.Comment = ""
+	result.Read1, result.ReadQual1 = bamReadBases(first)
+	result.Read2, result.ReadQual2 = bamReadBases(second)
+	var tags1, tags2 []sam.Aux
+	result.Barcode, result.Valid, tags1 = bamBarcode(first)
+	_, _, tags2 = bamBarcode(second)
+	result.Tags, result.MateTags = splitMateTags(tags1, tags2)
+	return nil
+}
+
+func (u *UnalignedBamSource) Close() error {
+	err := u.reader.Close()
+	if err2 := u.closer.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/* Does a BGZF stream decompress to something starting with the BAM magic? */
+func sniffBam(buffered *bufio.Reader) bool {
+	head, _ := buffered.Peek(18)
+	if len(head) < 18 || SniffCompression(head) != BGZF {
+		return false
+	}
+	/* BSIZE (total block size - 1) lives at offset 16 */
+	block, _ := buffered.Peek(int(head[16]) | int(head[17])<<8 + 1)
+	gz, err := gzip.NewReader(bytes.NewReader(block))
+	if err != nil {
+		return false
+	}
+	magic := make([]byte, len(bamMagic))
+	if _, err := io.ReadFull(gz, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, bamMagic)
+}
+
+/* Stitch a buffered view back together with the thing that closes it */
+type bufferedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+/*
+ * Open a single input that holds both reads of every pair: interleaved
+ * FASTQ (plain or compressed), unaligned BAM or CRAM (see openCram). A path
+ * of "-" reads from standard input.
+ */
+func OpenInterleavedFastQ(path string) (*FastQReader, error) {
+	var file io.ReadCloser = io.NopCloser(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+
+	buffered := bufio.NewReaderSize(file, 1<<17)
+	var bamStream io.Reader
+	var closer io.Closer
+	head, _ := buffered.Peek(len(cramMagic))
+	if bytes.Equal(head, cramMagic) {
+		decoder, err := openCram(buffered, file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		bamStream, closer = decoder, decoder
+	} else if sniffBam(buffered) {
+		bamStream, closer = buffered, file
+	}
+	if bamStream != nil {
+		br, err := bam.NewReader(bamStream, DecompressionThreads)
+		if err != nil {
+			closer.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		res := new(FastQReader)
+		res.Records = &UnalignedBamSource{reader: br, closer: closer}
+		return res, nil
+	}
+
+	source, err := NewZipReader(bufferedReadCloser{buffered, file})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return NewInterleavedFastQ(source), nil
+}
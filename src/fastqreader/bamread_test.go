@@ -0,0 +1,140 @@
+package fastqreader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bam "github.com/biogo/hts/bam"
+	sam "github.com/biogo/hts/sam"
+)
+
+/* Write an unaligned BAM of one read pair, with aux fields for each mate given as SAM text */
+func writeUnalignedBam(t *testing.T, path string, aux1, aux2 []string) {
+	header, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := bam.NewWriter(file, header, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mate, fields := range [][]string{aux1, aux2} {
+		var aux []sam.Aux
+		for _, field := range fields {
+			a, err := sam.ParseAux([]byte(field))
+			if err != nil {
+				t.Fatal(err)
+			}
+			aux = append(aux, a)
+		}
+		rec, err := sam.NewRecord("pair", nil, nil, -1, -1, 0, 0, nil, []byte("ACGT"), []byte{30, 30, 30, 30}, aux)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Flags = sam.Paired | sam.Unmapped | sam.MateUnmapped | sam.Read1
+		if mate == 1 {
+			rec.Flags = sam.Paired | sam.Unmapped | sam.MateUnmapped | sam.Read2
+		}
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tagText(tags []sam.Aux) string {
+	var text []string
+	for _, aux := range tags {
+		text = append(text, aux.String())
+	}
+	return strings.Join(text, " ")
+}
+
+func TestUnalignedBamBarcodesAndTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		aux1, aux2 []string
+		barcode    string
+		valid      bool
+		tags       string
+		mateTags   [2]string
+	}{
+		{"BX and VX", []string{"BX:Z:AAAA", "VX:i:0"}, []string{"BX:Z:AAAA", "VX:i:0"}, "AAAA", false, "", [2]string{}},
+		{"BX without VX", []string{"BX:Z:AAAA", "CB:Z:CCCC"}, []string{"BX:Z:AAAA", "CB:Z:CCCC"}, "AAAA", true, "CB:Z:CCCC", [2]string{}},
+		{"CB", []string{"CB:Z:CCCC", "RX:Z:CCCA"}, []string{"CB:Z:CCCC", "RX:Z:CCCA"}, "CCCC", true, "CB:Z:CCCC RX:Z:CCCA", [2]string{}},
+		{"RX only", []string{"RX:Z:CCCA"}, []string{"RX:Z:CCCA"}, "CCCA", false, "RX:Z:CCCA", [2]string{}},
+		{"per-mate tags", []string{"BX:Z:AAAA", "MI:i:1", "XA:Z:both"}, []string{"BX:Z:AAAA", "MI:i:2", "XA:Z:both", "XB:Z:r2"},
+			"AAAA", true, "XA:Z:both", [2]string{"MI:i:1", "MI:i:2 XB:Z:r2"}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "reads.bam")
+		writeUnalignedBam(t, path, test.aux1, test.aux2)
+		fqr, err := OpenInterleavedFastQ(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record FastQRecord
+		if err := fqr.ReadOneLine(&record); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		fqr.Close()
+		if string(record.Barcode) != test.barcode || record.Valid != test.valid {
+			t.Errorf("%s: barcode %q valid %v, want %q %v", test.name, record.Barcode, record.Valid, test.barcode, test.valid)
+		}
+		mateTags := [2]string{tagText(record.MateTags[0]), tagText(record.MateTags[1])}
+		if tagText(record.Tags) != test.tags || mateTags != test.mateTags {
+			t.Errorf("%s: tags %q and per mate %q, want %q and %q", test.name, tagText(record.Tags), mateTags, test.tags, test.mateTags)
+		}
+	}
+}
+
+/* A stand-in for samtools that "decodes" any CRAM to the given BAM, or fails */
+func fakeSamtools(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "samtools")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := samtoolsPath
+	samtoolsPath = path
+	t.Cleanup(func() { samtoolsPath = old })
+}
+
+func TestCramThroughSamtools(t *testing.T) {
+	dir := t.TempDir()
+	bamPath, cramPath := filepath.Join(dir, "reads.bam"), filepath.Join(dir, "reads.cram")
+	writeUnalignedBam(t, bamPath, []string{"BX:Z:AAAA", "VX:i:1"}, []string{"BX:Z:AAAA", "VX:i:1"})
+	if err := os.WriteFile(cramPath, []byte("CRAM\x03\x00 not really"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeSamtools(t, "cat >/dev/null; exec cat "+bamPath)
+	fqr, err := OpenInterleavedFastQ(cramPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record FastQRecord
+	if err := fqr.ReadOneLine(&record); err != nil || string(record.Barcode) != "AAAA" || string(record.Read1) != "ACGT" {
+		t.Errorf("decoded %q with barcode %q (error %v), want ACGT with AAAA", record.Read1, record.Barcode, err)
+	}
+	fqr.Close()
+
+	/* A CRAM samtools gives up on must not look like an empty one */
+	fakeSamtools(t, "echo 'no reference found' >&2; exit 1")
+	fqr, err = OpenInterleavedFastQ(cramPath)
+	if err == nil {
+		err = fqr.ReadOneLine(&record)
+		fqr.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "no reference found") {
+		t.Errorf("samtools failing gave %v, want its error", err)
+	}
+}
@@ -0,0 +1,221 @@
+package fastqreader
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * Settings for BucketByBarcode.
+ */
+type BucketConfig struct {
+	/* Where spill files go. Empty means os.TempDir() */
+	TempDir string
+	/* Largest spill file (in bytes) that is loaded into memory at once */
+	MemoryBudget int64
+	/* Number of spill files per partitioning pass */
+	Buckets int
+}
+
+/* Don't re-partition an oversized bucket more often than this */
+const maxBucketDepth = 4
+
+type spillFile struct {
+	path string
+	size int64
+}
+
+/* Pick a bucket for a barcode. The salt changes the hash on every re-partitioning pass */
+func bucketFor(barcode []byte, salt int, buckets int) int {
+	h := fnv.New64a()
+	h.Write([]byte{byte(salt)})
+	h.Write(barcode)
+	/* FNV's low bits only see the low bits of each input byte, so mix
+	 * the whole word down before taking the modulus (murmur3 finalizer)
+	 */
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return int(x % uint64(buckets))
+}
+
+/*
+ * Drain input into spill files under dir, hashing each record's barcode
+ * into one of "buckets" interleaved standard-format FASTQ files.
+ */
+func partitionByBarcode(input *FastQReader, dir string, salt int, buckets int) ([]spillFile, error) {
+	files := make([]*os.File, buckets)
+	writers := make([]*bufio.Writer, buckets)
+	spills := make([]spillFile, buckets)
+	for i := range files {
+		spills[i].path = filepath.Join(dir, fmt.Sprintf("bucket_%d_%04d.fq", salt, i))
+		f, err := os.Create(spills[i].path)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = f
+		writers[i] = bufio.NewWriter(f)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var record FastQRecord
+	var buf []byte
+	for {
+		err := input.ReadOneLine(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b := bucketFor(record.Barcode, salt, buckets)
+		buf = AppendStandardRecord(buf[:0], &record, 1)
+		buf = AppendStandardRecord(buf, &record, 2)
+		if _, err := writers[b].Write(buf); err != nil {
+			return nil, err
+		}
+		spills[b].size += int64(len(buf))
+	}
+
+	for i := range writers {
+		if err := writers[i].Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return spills, nil
+}
+
+/*
+ * Write every record of one spill file to out, grouped by barcode. Barcodes
+ * come out in the order they were first seen. Buckets that don't fit in
+ * the memory budget are partitioned again with a different hash.
+ */
+func replayBucket(spill spillFile, dir string, salt int, config BucketConfig, out io.Writer) error {
+	defer os.Remove(spill.path)
+	if spill.size == 0 {
+		return nil
+	}
+
+	source, err := FastZipReader(spill.path)
+	if err != nil {
+		return err
+	}
+	input := NewInterleavedFastQ(source)
+	defer input.Close()
+
+	if spill.size > config.MemoryBudget && salt < maxBucketDepth {
+		sub, err := partitionByBarcode(input, dir, salt+1, config.Buckets)
+		if err != nil {
+			return err
+		}
+		nonEmpty := 0
+		for _, s := range sub {
+			if s.size > 0 {
+				nonEmpty++
+			}
+		}
+		if nonEmpty > 1 {
+			for _, s := range sub {
+				if err := replayBucket(s, dir, salt+1, config, out); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		/* A single barcode (or a pathological hash) owns the whole
+		 * bucket. It has to be held in memory for RFA anyway.
+		 */
+		for _, s := range sub {
+			if s.size > 0 {
+				log.Printf("barcode bucket of %d bytes exceeds the %d byte memory budget and cannot be split further", s.size, config.MemoryBudget)
+				return replayBucket(s, dir, maxBucketDepth, config, out)
+			}
+		}
+		return nil
+	}
+
+	order := [][]FastQRecord{}
+	index := map[string]int{}
+	for {
+		var record FastQRecord
+		err := input.ReadOneLine(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		i, ok := index[string(record.Barcode)]
+		if !ok {
+			i = len(order)
+			index[string(record.Barcode)] = i
+			order = append(order, nil)
+		}
+		order[i] = append(order[i], record)
+	}
+
+	var buf []byte
+	for _, group := range order {
+		for i := range group {
+			buf = AppendStandardRecord(buf[:0], &group[i], 1)
+			buf = AppendStandardRecord(buf, &group[i], 2)
+			if _, err := out.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Make input usable by ReadBarcodeSet even if it isn't sorted by barcode.
+ * All of input is read up front and spilled into hash buckets on disk; the
+ * returned reader replays the buckets with every barcode's reads
+ * contiguous. Closing the returned reader stops the replay and removes the
+ * spill files. input is closed once it has been drained.
+ */
+func BucketByBarcode(input *FastQReader, config BucketConfig) (*FastQReader, error) {
+	if config.Buckets <= 0 {
+		config.Buckets = 64
+	}
+	if config.MemoryBudget <= 0 {
+		config.MemoryBudget = 1 << 30
+	}
+
+	dir, err := os.MkdirTemp(config.TempDir, "arachne-buckets-")
+	if err != nil {
+		return nil, err
+	}
+
+	spills, err := partitionByBarcode(input, dir, 0, config.Buckets)
+	input.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer os.RemoveAll(dir)
+		out := bufio.NewWriterSize(pw, 1<<20)
+		for _, spill := range spills {
+			if err := replayBucket(spill, dir, 0, config, out); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(out.Flush())
+	}()
+
+	return NewInterleavedFastQ(MakeZipReader(pr, Plain, pr)), nil
+}
@@ -0,0 +1,78 @@
+package fastqreader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/* The samtools that CRAM input is decoded with, looked up on the PATH */
+var samtoolsPath = "samtools"
+
+/*
+ * A CRAM stream being decoded to uncompressed BAM by "samtools view".
+ * biogo/hts can read CRAM containers but not the records in them, and
+ * samtools already knows how to find the reference a CRAM was compressed
+ * against (REF_PATH, REF_CACHE or the header's UR fields). If samtools
+ * fails, its error is returned in place of the end of the stream, so that
+ * a CRAM it gave up on part way isn't taken for a short one.
+ */
+type cramDecoder struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	input  io.Closer
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+/* Start decoding the CRAM read from input, which closer closes */
+func openCram(input io.Reader, closer io.Closer) (*cramDecoder, error) {
+	d := &cramDecoder{input: closer}
+	d.cmd = exec.Command(samtoolsPath, "view", "-u", "-")
+	d.cmd.Stdin = input
+	d.cmd.Stderr = &d.stderr
+	/* Don't wait on standard input forever if samtools is stopped early */
+	d.cmd.WaitDelay = time.Second
+	stdout, err := d.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	d.stdout = stdout
+	if err := d.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("CRAM input is decoded with samtools, which couldn't be run: %v", err)
+	}
+	return d, nil
+}
+
+func (d *cramDecoder) wait() error {
+	if !d.waited {
+		d.waited = true
+		if err := d.cmd.Wait(); err != nil {
+			d.err = fmt.Errorf("samtools failed to decode the CRAM (%v): %s", err, strings.TrimSpace(d.stderr.String()))
+		}
+	}
+	return d.err
+}
+
+func (d *cramDecoder) Read(p []byte) (int, error) {
+	n, err := d.stdout.Read(p)
+	if err == io.EOF {
+		if err := d.wait(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+/* Stop samtools if it is still running and close the input */
+func (d *cramDecoder) Close() error {
+	if !d.waited {
+		d.cmd.Process.Kill()
+		d.wait()
+	}
+	return d.input.Close()
+}
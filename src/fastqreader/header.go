@@ -0,0 +1,204 @@
+package fastqreader
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/*
+ * The interesting bits of a FASTQ header line. Accepts the 'standard'
+ * linked-read layout (@name/1<TAB>BX:Z:..<TAB>VX:i:..), Casava 1.8
+ * comments (@name 1:N:0:ACGT BX:Z:..), names without a /1 or /2 suffix
+ * and SAM tags in any order, separated by tabs or spaces.
+ */
+type ReadHeader struct {
+	/* Read name without the '@', the /1 /2 suffix or any comment */
+	Name string
+	/* 1 or 2 if the header says which mate it is, 0 otherwise */
+	Mate int
+	/* Contents of BX:Z, nil if there was no BX tag */
+	Barcode []byte
+	/* VX:i was present and non-zero */
+	Valid bool
+	/* VX:i was present at all */
+	HasValid bool
+	/* The value of VX:i as written, empty if absent */
+	ValidText string
+	/* Contents of RG:Z, empty if absent */
+	ReadGroup string
+	/* Every other SAM tag, typed, in the order it appeared */
+	Tags []sam.Aux
+	/* Everything after the name, verbatim */
+	Comment string
+}
+
+/*
+ * Returned when the input isn't a well formed (pair of) FASTQ file(s).
+ */
+type ParseError struct {
+	/* Which input: "R1", "R2" or "interleaved R2" */
+	Source string
+	/* 1-based line number in that input */
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s line %d: %s", e.Source, e.Line, e.Msg)
+}
+
+/*
+ * Returned for a pair whose R1 and R2 headers don't go together. Both records
+ * (and any index reads) were read whole and are in the record, so reading can
+ * carry on past it.
+ */
+type MateError struct {
+	*ParseError
+}
+
+func (e *MateError) Unwrap() error {
+	return e.ParseError
+}
+
+/* Does a whitespace delimited field look like a SAM tag (XX:T:value)? */
+func isSamTag(field string) bool {
+	return len(field) >= 5 && field[2] == ':' && field[4] == ':'
+}
+
+/* Does a whitespace delimited field look like a Casava 1.8 comment (1:N:0:...)? */
+func isCasavaComment(field string) bool {
+	return len(field) >= 4 && (field[0] == '1' || field[0] == '2') && field[1] == ':' &&
+		(field[2] == 'Y' || field[2] == 'N') && field[3] == ':'
+}
+
+/*
+ * Parse a header line. The leading '@' and trailing newline are optional.
+ */
+func ParseReadHeader(line string) ReadHeader {
+	var h ReadHeader
+
+	line = strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "@")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return h
+	}
+
+	h.Name = fields[0]
+	h.Comment = strings.TrimSpace(line[len(fields[0]):])
+	if n := len(h.Name); n > 2 && h.Name[n-2] == '/' && (h.Name[n-1] == '1' || h.Name[n-1] == '2') {
+		h.Mate = int(h.Name[n-1] - '0')
+		h.Name = h.Name[:n-2]
+	}
+
+	for _, field := range fields[1:] {
+		switch {
+		case isSamTag(field):
+			switch field[:5] {
+			case "BX:Z:":
+				h.Barcode = []byte(field[5:])
+			case "VX:i:":
+				h.HasValid = true
+				h.ValidText = field[5:]
+				h.Valid = h.ValidText != "0"
+			case "RG:Z:":
+				h.ReadGroup = field[5:]
+			default:
+				/* Malformed tags are dropped rather than failing the read */
+				if aux, err := sam.ParseAux([]byte(field)); err == nil {
+					h.Tags = append(h.Tags, aux)
+				}
+			}
+		case isCasavaComment(field):
+			if h.Mate == 0 {
+				h.Mate = int(field[0] - '0')
+			}
+		}
+	}
+	return h
+}
+
+/* Parse a read header and find the barcode. Return the sanitized header, barcode, and 1/0 whether it's valid or not */
+func ParseHeader(seq_id string) (string, []byte, bool) {
+	h := ParseReadHeader(seq_id)
+	if h.Barcode == nil {
+		return h.Name, []byte(""), false
+	}
+	return h.Name, h.Barcode, h.Valid
+}
+
+/* Does tags hold a tag with exactly this type and value? */
+func containsAux(tags []sam.Aux, aux sam.Aux) bool {
+	for _, other := range tags {
+		if bytes.Equal(other, aux) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Split the tags of the two mates of a pair into those both have, and those
+ * only one of them has (or has with a different value). Mates nearly always
+ * carry the same tags, in which case there are no per-mate ones.
+ */
+func splitMateTags(r1, r2 []sam.Aux) ([]sam.Aux, [2][]sam.Aux) {
+	var mate [2][]sam.Aux
+	same := len(r1) == len(r2)
+	for i := 0; same && i < len(r1); i++ {
+		same = bytes.Equal(r1[i], r2[i])
+	}
+	if same {
+		return r1, mate
+	}
+	var shared []sam.Aux
+	for _, aux := range r1 {
+		if containsAux(r2, aux) {
+			shared = append(shared, aux)
+		} else {
+			mate[0] = append(mate[0], aux)
+		}
+	}
+	for _, aux := range r2 {
+		if !containsAux(r1, aux) {
+			mate[1] = append(mate[1], aux)
+		}
+	}
+	return shared, mate
+}
+
+/*
+ * Check that the two headers of a pair describe mates of the same read.
+ */
+func checkMates(r1, r2 ReadHeader) string {
+	if r1.Name != r2.Name {
+		return fmt.Sprintf("read names differ: R1 has %q, R2 has %q (are the files out of sync?)", r1.Name, r2.Name)
+	}
+	if r1.Mate == 2 {
+		return fmt.Sprintf("read %q in R1 is marked as mate 2", r1.Name)
+	}
+	if r2.Mate == 1 {
+		return fmt.Sprintf("read %q in R2 is marked as mate 1", r2.Name)
+	}
+	return ""
+}
+
+/*
+ * Format a tag the way it appears in SAM text (and so in a FASTQ comment).
+ * sam.Aux.String doesn't do this for B arrays.
+ */
+func FormatTag(aux sam.Aux) string {
+	if aux.Type() != 'B' {
+		return aux.String()
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:B:%c", aux.Tag(), aux[3])
+	values := reflect.ValueOf(aux.Value())
+	for i := 0; i < values.Len(); i++ {
+		fmt.Fprintf(&sb, ",%v", values.Index(i).Interface())
+	}
+	return sb.String()
+}
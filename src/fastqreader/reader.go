@@ -4,10 +4,13 @@ package fastqreader
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"log"
-	"regexp"
 	"strings"
+
+	sam "github.com/biogo/hts/sam"
 )
 
 /*
@@ -22,6 +25,15 @@ type FastQRecord struct {
 	Valid       bool
 	ReadInfo    string
 	ReadGroupId string
+	/* SAM tags from the input other than BX and VX, to carry into the output */
+	Tags []sam.Aux
+	/* Input tags that only R1 (0) or R2 (1) has, on top of Tags */
+	MateTags [2][]sam.Aux
+	/* The R1 header after the read name, verbatim (tags, Casava comment, ...) */
+	Comment string
+	/* Sequences and qualities of any index reads (I1, I2) read alongside */
+	Index     [][]byte
+	IndexQual [][]byte
 }
 
 /*
@@ -52,7 +64,11 @@ func Min(x, y int) int {
  * as well as sets of records (on the same barcode) from a fastq file
  */
 type FastQReader struct {
-	Line          int
+	/* Number of read pairs returned so far */
+	Line int
+	/* Number of lines consumed from each input, for error messages */
+	R1Line        int
+	R2Line        int
 	LastBarcode   []byte
 	DefferedError error
 	Pending       *FastQRecord
@@ -60,6 +76,21 @@ type FastQReader struct {
 	R1Buffer      *bufio.Reader
 	R2Source      *ZipReader
 	R2Buffer      *bufio.Reader
+	/* R1 and R2 alternate in R1Source; R2Source and R2Buffer are nil */
+	Interleaved bool
+	/* Pairs come from here rather than from FASTQ when set (e.g. uBAM) */
+	Records RecordSource
+	/* Parsed headers of the last pair read from FASTQ, for validation */
+	R1Header ReadHeader
+	R2Header ReadHeader
+	/* Index read FASTQs (I1, I2) read in lockstep with the pairs */
+	IndexSources []*ZipReader
+	IndexBuffers []*bufio.Reader
+	IndexLines   []int
+	/* Most records ReadBarcodeSet returns at once, DefaultMaxBarcodeReads if 0 */
+	MaxBarcodeReads int
+	/* The last set was cut short by MaxBarcodeReads, so the next one continues its barcode */
+	Truncated bool
 }
 
 /* Open a new fastQ file */
@@ -83,43 +114,120 @@ func OpenFastQ(R1 string, R2 string) (*FastQReader, error) {
 	return res, nil
 }
 
-//func readUntilWhitespace(b string) string {
-//	idx := strings.IndexFunc(b, unicode.IsSpace)
-//	if idx == -1 {
-//		return b // No whitespace found, return entire slice
-//	}
-//	return b[:idx]
-//}
-
-/* Parse a read header and find the barcode. Return the sanitized header, barcode, and 1/0 whether it's valid or not */
-func ParseHeader(seq_id string) (string, []byte, bool) {
-	var _barcode []byte
-	var _valid bool
-
-	// stringify the input
-	// get the first part before the whitespaces
-	_id := strings.Fields(seq_id)[0]
-	_header := _id[:len(_id)-2]
-
-	// regex match BX:Z:*
-	bxRe := regexp.MustCompile(`BX:Z:(\S+)\s`)
-	bxMatches := bxRe.FindStringSubmatch(seq_id)
-	if len(bxMatches) > 1 {
-		_barcode = []byte(bxMatches[1])
+/* Read interleaved pairs from an already open source */
+func NewInterleavedFastQ(source *ZipReader) *FastQReader {
+	var res = new(FastQReader)
+
+	res.R1Source = source
+	res.R1Buffer = bufio.NewReader(res.R1Source)
+	res.Interleaved = true
+	res.Line = 0
+	return res
+}
+
+/*
+ * Open paired input. An empty R2 means R1 holds both reads of each pair
+ * (interleaved FASTQ or unaligned BAM).
+ */
+func OpenPairedFastQ(R1 string, R2 string) (*FastQReader, error) {
+	if R2 == "" {
+		return OpenInterleavedFastQ(R1)
+	}
+	return OpenFastQ(R1, R2)
+}
+
+/*
+ * Read an index read FASTQ (I1 then I2) alongside the pairs. Every pair
+ * then carries the matching index read in Index/IndexQual. Only works for
+ * FASTQ input.
+ */
+func (fqr *FastQReader) AddIndexReads(path string) error {
+	if fqr.Records != nil {
+		return fmt.Errorf("%s: index reads can only be read alongside FASTQ input", path)
+	}
+	source, err := FastZipReader(path)
+	if err != nil {
+		return err
+	}
+	fqr.IndexSources = append(fqr.IndexSources, source)
+	fqr.IndexBuffers = append(fqr.IndexBuffers, bufio.NewReader(source))
+	fqr.IndexLines = append(fqr.IndexLines, 0)
+	return nil
+}
+
+/* Release the underlying files and any decompression goroutines */
+func (fqr *FastQReader) Close() error {
+	var err error
+	if fqr.Records != nil {
+		err = fqr.Records.Close()
 	} else {
-		return "", []byte(""), false
+		err = fqr.R1Source.Close()
+		if fqr.R2Source != nil {
+			if err2 := fqr.R2Source.Close(); err == nil {
+				err = err2
+			}
+		}
 	}
-	// regex match VX:i:[01]
-	vxRe := regexp.MustCompile(`VX:i:([01])\s`)
-	vxMatches := vxRe.FindStringSubmatch(seq_id)
-	if len(vxMatches) > 1 {
-		if vxMatches[1] == "0" {
-			_valid = false
-		} else {
-			_valid = true
+	for _, source := range fqr.IndexSources {
+		if err2 := source.Close(); err == nil {
+			err = err2
 		}
 	}
-	return _header, _barcode, _valid
+	return err
+}
+
+/*
+ * Is there nothing but blank lines left in a stream? Consumes what is left.
+ */
+func atEnd(buffer *bufio.Reader) bool {
+	for {
+		text, err := buffer.ReadString(byte('\n'))
+		if strings.TrimRight(text, "\r\n") != "" {
+			return false
+		}
+		if err != nil {
+			return err == io.EOF
+		}
+	}
+}
+
+/*
+ * Pull the next 4-line record out of one stream. The returned header still
+ * has its leading '@'; sequence and quality have their newline removed.
+ * "line" is the stream's line counter and is advanced past the record.
+ */
+func readRecord(buffer *bufio.Reader, name string, line *int) (string, []byte, []byte, error) {
+
+	header, err := buffer.ReadString(byte('\n'))
+	if err != nil && (err != io.EOF || len(header) == 0) {
+		return "", nil, nil, err
+	}
+	*line++
+	if strings.TrimRight(header, "\r\n") == "" && atEnd(buffer) {
+		/* Blank lines are allowed at the end of the stream */
+		return "", nil, nil, io.EOF
+	}
+	if header[0] != byte('@') {
+		return "", nil, nil, &ParseError{name, *line, fmt.Sprintf("expected a header starting with '@', found %q", strings.TrimRight(header, "\r\n"))}
+	}
+
+	/* Load the sequence, "+" and quality lines */
+	var fastq_lines [3][]byte
+	for i := range fastq_lines {
+		text, err := buffer.ReadBytes(byte('\n'))
+		if err != nil && (err != io.EOF || len(text) == 0) {
+			if err == io.EOF {
+				return "", nil, nil, &ParseError{name, *line, "file ends in the middle of a record"}
+			}
+			return "", nil, nil, err
+		}
+		*line++
+		fastq_lines[i] = bytes.TrimRight(text, "\r\n")
+	}
+	if len(fastq_lines[1]) == 0 || fastq_lines[1][0] != byte('+') {
+		return "", nil, nil, &ParseError{name, *line - 1, fmt.Sprintf("expected a '+' separator line, found %q", fastq_lines[1])}
+	}
+	return header, fastq_lines[0], fastq_lines[2], nil
 }
 
 /*
@@ -127,65 +235,99 @@ func ParseHeader(seq_id string) (string, []byte, bool) {
 */
 func (fqr *FastQReader) ReadOneLine(result *FastQRecord) error {
 
-	/* Search for the next start-of-record.*/
-	for {
-		fqr.Line++
-		R1_line, err := fqr.R1Buffer.ReadString(byte('\n'))
-		if err != nil {
-			return err
+	if fqr.Records != nil {
+		err := fqr.Records.ReadRecord(result)
+		if err == nil {
+			fqr.Line++
 		}
-		R2_line, err := fqr.R2Buffer.ReadString(byte('\n'))
-		if err != nil {
-			return err
+		return err
+	}
+
+	R2_source := fqr.R2Buffer
+	R2_line_number := &fqr.R2Line
+	R2_name := "R2"
+	if fqr.Interleaved {
+		/* The mate is the very next record in the same stream */
+		R2_source = fqr.R1Buffer
+		R2_line_number = &fqr.R1Line
+		R2_name = "interleaved R2"
+	}
+
+	R1_line, read1, qual1, err := readRecord(fqr.R1Buffer, "R1", &fqr.R1Line)
+	if err != nil {
+		if err == io.EOF && !fqr.Interleaved {
+			/* Both files have to run out together */
+			if !atEnd(fqr.R2Buffer) {
+				return &ParseError{"R2", fqr.R2Line + 1, "R2 has more records than R1"}
+			}
 		}
-		if R1_line[0] == byte('@') {
-			/* Found it! */
-			result.ReadInfo, result.Barcode, result.Valid = ParseHeader(string(R1_line[1:]))
-			R1_fields := strings.Fields(string(R1_line[1 : len(R1_line)-1]))
-
-			// TODO
-			// I GET THE SENSE THIS IS WRONG FOR STANDARD FORMAT FASTQ
-			// IT IS, THIS SHOULD BE IGNORED OR REPLACED WITH THE RG ADDED IN THE CLI
-			if len(R1_fields) < 2 {
-				result.ReadGroupId = "" // no RGID found
-			} else {
-				result.ReadGroupId = R1_fields[len(R1_fields)-1]
+		if err == io.EOF {
+			for i, buffer := range fqr.IndexBuffers {
+				if !atEnd(buffer) {
+					return &ParseError{fmt.Sprintf("I%d", i+1), fqr.IndexLines[i] + 1, fmt.Sprintf("I%d has more records than R1", i+1)}
+				}
 			}
-			break
-		} else {
-			log.Printf("Bad line in R1: %v at %v", string(R1_line), fqr.Line)
-			log.Printf("Bad line in R2: %v at %v", string(R2_line), fqr.Line)
 		}
+		return err
+	}
+	R2_header_start := *R2_line_number + 1
+	R2_line, read2, qual2, err := readRecord(R2_source, R2_name, R2_line_number)
+	if err != nil {
+		if err == io.EOF {
+			return &ParseError{R2_name, R2_header_start, "R1 has more records than R2"}
+		}
+		return err
+	}
+	fqr.Line++
+
+	R1_header := ParseReadHeader(R1_line)
+	fqr.R1Header = R1_header
+	fqr.R2Header = ParseReadHeader(R2_line)
+	result.ReadInfo = R1_header.Name
+	result.Barcode = R1_header.Barcode
+	if result.Barcode == nil {
+		result.Barcode = []byte("")
 	}
+	result.Valid = R1_header.Valid
+	result.ReadGroupId = R1_header.ReadGroup
+	result.Tags, result.MateTags = splitMateTags(R1_header.Tags, fqr.R2Header.Tags)
+	result.Comment = R1_header.Comment
 
-	/* Load the 4 lines for this record */
-	var fastq_lines [6][]byte
-	for i := range 4 {
-		// skip the line with the + sign
-		if i == 2 {
-			continue
+	/* Assign them to the right fields in the FastQRecord struct */
+	result.Read1 = read1
+	result.ReadQual1 = qual1
+	result.Read2 = read2
+	result.ReadQual2 = qual2
+
+	if err := fqr.readIndexReads(result); err != nil {
+		return err
+	}
+	if msg := checkMates(R1_header, fqr.R2Header); msg != "" {
+		return &MateError{&ParseError{R2_name, R2_header_start, msg}}
+	}
+	return nil
+}
+
+/* Pull the index reads that go with the pair just read */
+func (fqr *FastQReader) readIndexReads(result *FastQRecord) error {
+	result.Index = nil
+	result.IndexQual = nil
+	for i, buffer := range fqr.IndexBuffers {
+		name := fmt.Sprintf("I%d", i+1)
+		header_start := fqr.IndexLines[i] + 1
+		header, seq, qual, err := readRecord(buffer, name, &fqr.IndexLines[i])
+		if err == io.EOF {
+			return &ParseError{name, header_start, "R1 has more records than " + name}
 		}
-		var err error
-		var line []byte
-		line, err = fqr.R1Buffer.ReadBytes(byte('\n'))
-		fastq_lines[i] = line[0 : len(line)-1]
 		if err != nil {
 			return err
 		}
-		line, err = fqr.R2Buffer.ReadBytes(byte('\n'))
-		fastq_lines[i+3] = line[0 : len(line)-1]
-		if err != nil {
-			return err
+		if index_name := ParseReadHeader(header).Name; index_name != result.ReadInfo {
+			return &ParseError{name, header_start, fmt.Sprintf("read names differ: R1 has %q, %s has %q (are the files out of sync?)", result.ReadInfo, name, index_name)}
 		}
+		result.Index = append(result.Index, seq)
+		result.IndexQual = append(result.IndexQual, qual)
 	}
-
-	/* Assign them to the right fields in the FastQRecord struct */
-	result.Read1 = fastq_lines[1]
-	result.ReadQual1 = fastq_lines[2]
-	result.Read2 = fastq_lines[4]
-	result.ReadQual2 = fastq_lines[5]
-	// MAYBE A THING FOR COMMENTS?
-
 	return nil
 }
 
@@ -200,92 +342,92 @@ func DifferentBarcode(a []byte, b []byte) bool {
 	}
 }
 
+/* Default cap on the number of records in one barcode set */
+const DefaultMaxBarcodeReads = 30000
+
+/* Fewest read pairs a valid barcode needs for RFA, unless told otherwise */
+const DefaultMinRFAReads = 5
+
 /*
- * Reaturn an array of all of the reads with the same barcode.
+ * Return an array of all of the reads with the same barcode, at most
+ * MaxBarcodeReads of them. A barcode with more reads than that comes back
+ * over several calls. The boolean is true when the array holds all of the
+ * barcode's reads, and false for every part of a barcode that was split.
  * "space" may be null or may be the result of a previous call to this function.
  * If present the array will be destructively re-used
  */
 func (fqr *FastQReader) ReadBarcodeSet(space *[]FastQRecord) ([]FastQRecord, error, bool) {
-	new_barcode := false
 	if fqr.DefferedError != nil {
 		return nil, fqr.DefferedError, false
 	}
+	limit := fqr.MaxBarcodeReads
+	if limit <= 0 {
+		limit = DefaultMaxBarcodeReads
+	}
 	var record_array []FastQRecord
 	if space == nil {
-		/* Allocate some space, guessing at most 1 million reads per
-		 * barcode. GO will transparently extend this array if needed
-		 */
-		record_array = make([]FastQRecord, 0, 1000000)
+		/* GO will transparently extend this array if needed */
+		record_array = make([]FastQRecord, 0, min(limit, 1024))
 	} else {
 		/* Re-use (but truncate) space */
 		record_array = (*space)[0:0]
 	}
 
-	var index = 0
-
 	/* Is there a pending element from a previous call that needs to be
 	 * put in the output?
 	 */
 	if fqr.Pending != nil {
 		record_array = append(record_array, *fqr.Pending)
 		fqr.Pending = nil
-		index++
+	} else {
+		var record FastQRecord
+		if err := fqr.ReadOneLine(&record); err != nil {
+			if err != io.EOF {
+				log.Printf("Error: %v", err)
+			}
+			return nil, err, false
+		}
+		record_array = append(record_array, record)
 	}
+	continued := fqr.Truncated && fqr.LastBarcode != nil && !DifferentBarcode(record_array[0].Barcode, fqr.LastBarcode)
 
-	/* Load fastQ records into record_array */
-	for ; index < 30000; index++ {
-		record_array = append(record_array, FastQRecord{})
-		err := fqr.ReadOneLine(&record_array[index])
-
+	/* Load fastQ records into record_array. One more than the limit is
+	 * read, to tell a barcode that ends right at the limit from one that
+	 * goes on past it.
+	 */
+	fqr.Truncated = false
+	for {
+		var record FastQRecord
+		err := fqr.ReadOneLine(&record)
 		if err != nil {
-			/* Something went wrong. If we have data, return it and
-			 * defer the error to the next invocation. Otherwise,
-			 * return the error now.
+			/* Something went wrong. Return the data we have and
+			 * defer the error to the next invocation.
 			 */
 			if err != io.EOF {
 				log.Printf("Error: %v", err)
 			}
-
-			if index == 0 {
-				return nil, err, false
-			} else {
-				fqr.DefferedError = err
-				break
-			}
+			fqr.DefferedError = err
+			break
 		}
-
-		if DifferentBarcode(record_array[0].Barcode, record_array[index].Barcode) {
-			/* Just transitioned to a new barcode. This record needs to
-			 * be defered for next time we're called (since its on the
-			 * _new_ barcode).
-			 */
-			fqr.Pending = new(FastQRecord)
-			*fqr.Pending = record_array[index]
-			new_barcode = true
+		/* Either the next barcode's first record or more of this one,
+		 * it is kept for next time
+		 */
+		if DifferentBarcode(record_array[0].Barcode, record.Barcode) {
+			fqr.Pending = &record
 			break
-		} else if fqr.LastBarcode != nil && !DifferentBarcode(record_array[0].Barcode, fqr.LastBarcode) && index >= 200 {
-			new_barcode = false
-			log.Printf("abnormal break: %s", string(record_array[0].Barcode))
+		}
+		if len(record_array) == limit {
+			fqr.Pending = &record
+			fqr.Truncated = true
 			break
 		}
-
+		record_array = append(record_array, record)
 	}
-	if len(record_array) > 0 {
-		tmp := make([]byte, len(record_array[0].Barcode))
-		copy(tmp, record_array[0].Barcode)
-		fqr.LastBarcode = tmp
-	}
-	//log.Printf("Load %v record %s %s %s %s", index, string(record_array[0].Barcode), string(record_array[index].Barcode), string(record_array[0].Barcode), string(record_array[index].Barcode))
-	/* Truncate the last record of the array. It is either eroneous and ill defined
-	 * or it belongs to the next GEM.
-	 */
 
-	end := len(record_array)
-	if new_barcode || fqr.DefferedError == io.EOF {
-		end -= 1
-	} else if fqr.DefferedError != io.EOF {
-		return record_array[0:end], nil, false
-	}
-	return record_array[0:end], nil, true
+	tmp := make([]byte, len(record_array[0].Barcode))
+	copy(tmp, record_array[0].Barcode)
+	fqr.LastBarcode = tmp
 
+	complete := !continued && !fqr.Truncated && (fqr.DefferedError == nil || fqr.DefferedError == io.EOF)
+	return record_array, nil, complete
 }
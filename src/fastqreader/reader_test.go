@@ -0,0 +1,52 @@
+package fastqreader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlankLinesAtEnd(t *testing.T) {
+	r1 := "@a/1\tBX:Z:AAAA\tVX:i:1\nACGT\n+\nIIII\n"
+	r2 := "@a/2\tBX:Z:AAAA\tVX:i:1\nTTTT\n+\nIIII\n"
+	tests := []struct {
+		name    string
+		r1, r2  string
+		pairs   int
+		wantErr bool
+	}{
+		{"none", r1, r2, 1, false},
+		{"blank lines after R1", r1 + "\n\n", r2, 1, false},
+		{"blank line after R2, CRLF", r1, r2 + "\r\n", 1, false},
+		{"interleaved", r1 + r2 + "\n", "", 1, false},
+		{"blank line between records", r1 + "\n" + r1, r2 + r2, 1, true},
+		{"R2 has another record after a blank line", r1, r2 + "\n" + r2, 1, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		path1, path2 := filepath.Join(dir, "R1.fq"), ""
+		if err := os.WriteFile(path1, []byte(test.r1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.r2 != "" {
+			path2 = filepath.Join(dir, "R2.fq")
+			if err := os.WriteFile(path2, []byte(test.r2), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fqr, err := OpenPairedFastQ(path1, path2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs := 0
+		var record FastQRecord
+		for err = fqr.ReadOneLine(&record); err == nil; err = fqr.ReadOneLine(&record) {
+			pairs++
+		}
+		fqr.Close()
+		if pairs != test.pairs || (err != io.EOF) != test.wantErr {
+			t.Errorf("%s: read %d pairs and then %v, want %d pairs and an error %v", test.name, pairs, err, test.pairs, test.wantErr)
+		}
+	}
+}
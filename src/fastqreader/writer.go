@@ -0,0 +1,61 @@
+package fastqreader
+
+import (
+	"io"
+)
+
+/*
+ * Format one half of a read pair as a 'standard' linked-read FASTQ record:
+ * "@name/<mate>\tBX:Z:<barcode>\tVX:i:<0|1>", then RG, the pair's other tags
+ * and the mate's own, followed by sequence, '+' and qualities. The record is
+ * appended to buf, which is returned.
+ */
+func AppendStandardRecord(buf []byte, record *FastQRecord, mate int) []byte {
+	seq, qual := record.Read1, record.ReadQual1
+	if mate == 2 {
+		seq, qual = record.Read2, record.ReadQual2
+	}
+
+	buf = append(buf, '@')
+	buf = append(buf, record.ReadInfo...)
+	buf = append(buf, '/', byte('0'+mate))
+	buf = append(buf, "\tBX:Z:"...)
+	buf = append(buf, record.Barcode...)
+	if record.Valid {
+		buf = append(buf, "\tVX:i:1"...)
+	} else {
+		buf = append(buf, "\tVX:i:0"...)
+	}
+	if record.ReadGroupId != "" {
+		buf = append(buf, "\tRG:Z:"...)
+		buf = append(buf, record.ReadGroupId...)
+	}
+	for _, tag := range record.Tags {
+		buf = append(buf, '\t')
+		buf = append(buf, FormatTag(tag)...)
+	}
+	for _, tag := range record.MateTags[mate-1] {
+		buf = append(buf, '\t')
+		buf = append(buf, FormatTag(tag)...)
+	}
+	buf = append(buf, '\n')
+	buf = append(buf, seq...)
+	buf = append(buf, "\n+\n"...)
+	buf = append(buf, qual...)
+	buf = append(buf, '\n')
+	return buf
+}
+
+/* Write one half (mate 1 or 2) of a record in the standard format */
+func WriteStandardRecord(w io.Writer, record *FastQRecord, mate int) error {
+	_, err := w.Write(AppendStandardRecord(nil, record, mate))
+	return err
+}
+
+/* Write both halves of a record, R1 first, as interleaved standard FASTQ */
+func WriteInterleavedRecord(w io.Writer, record *FastQRecord) error {
+	buf := AppendStandardRecord(nil, record, 1)
+	buf = AppendStandardRecord(buf, record, 2)
+	_, err := w.Write(buf)
+	return err
+}
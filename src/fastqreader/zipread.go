@@ -3,11 +3,56 @@
 package fastqreader
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"runtime"
+
+	"github.com/biogo/hts/bgzf"
+	"github.com/klauspost/compress/zstd"
 )
 
+/*
+ * The compression schemes that FastZipReader knows how to undo. The
+ * scheme is decided by sniffing the first bytes of the input, never by
+ * the file extension.
+ */
+type Compression int
+
+const (
+	Plain Compression = iota
+	Gzip
+	BGZF
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case BGZF:
+		return "bgzf"
+	case Zstd:
+		return "zstd"
+	default:
+		return "plain"
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+/*
+ * Number of goroutines used to inflate BGZF blocks and zstd frames.
+ * Zero or less means "use every CPU".
+ */
+var DecompressionThreads = 0
+
 /*
  * We need a "ZipReader" reader object. A ZipReader contains a source reader
  * but implements a read function that retries if the source reader returned
@@ -16,7 +61,10 @@ import (
 type ZipReader struct {
 	/* The exact reader that was passed to us */
 	Source io.Reader
-	Cmd    *exec.Cmd
+	/* What the input turned out to be compressed with */
+	Compression Compression
+	/* Things to close (innermost first) when we are done */
+	closers []io.Closer
 }
 
 /*
@@ -34,52 +82,213 @@ func (r ZipReader) Read(data []byte) (int, error) {
 	var offset int
 	/* How much data did we just read*/
 	var read_len int
-	/* Real programmers never use curley braces. They just write all their code as
-	 * increment and check conditions in a body-less for loop.
+	/* Readers are allowed to hand back data together with io.EOF, so the
+	 * bytes from the final read have to be counted before err is checked.
 	 */
-	for offset = 0; offset < want && err == nil; read_len, err = r.Source.Read(data[offset:]) {
+	for offset = 0; offset < want && err == nil; {
+		read_len, err = r.Source.Read(data[offset:])
 		offset += read_len
 	}
 
 	return offset, err
 }
 
-func (r ZipReader) Close() {
+func (r ZipReader) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
 
-	r.Source.(io.ReadCloser).Close()
-	r.Cmd.Wait()
+func MakeZipReader(src io.Reader, compression Compression, closers ...io.Closer) *ZipReader {
+	return &ZipReader{Source: src, Compression: compression, closers: closers}
 }
 
-func MakeZipReader(src io.Reader, cmd *exec.Cmd) *ZipReader {
-	return &ZipReader{src, cmd}
+/*
+ * Decide what an input is compressed with from its first few bytes. BGZF
+ * is a gzip member whose FEXTRA field carries a "BC" subfield, so it has to
+ * be told apart from ordinary gzip by looking inside the header.
+ */
+func SniffCompression(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(head, gzipMagic):
+		/* FLG.FEXTRA set, XLEN at 10, first subfield id at 12 */
+		if len(head) >= 16 && head[3]&0x04 != 0 && head[12] == 'B' && head[13] == 'C' {
+			return BGZF
+		}
+		return Gzip
+	default:
+		return Plain
+	}
 }
 
 /*
- * Implement an "uncompressing" reader that uses the system's
- * gunzip program to uncompress the input file.  We do this
- * because the system gzip is much much faster than the go library
+ * Wrap an already open stream in whichever decompressor its magic bytes
+ * call for. The returned ZipReader owns src and closes it on Close.
  */
-func FastZipReader(path string) (*ZipReader, error) {
-	/* Setup a "Cmd" structure to describe the command we
-	 * want to execute
-	 * */
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		panic("no such file or directory: " + path)
+func NewZipReader(src io.ReadCloser) (*ZipReader, error) {
+	threads := DecompressionThreads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
 	}
-	cmd := exec.Command("gunzip", "-c", path)
-	stdout, err := cmd.StdoutPipe()
 
-	if err != nil {
+	buffered := bufio.NewReaderSize(src, 1<<20)
+	head, err := buffered.Peek(16)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		src.Close()
 		return nil, err
 	}
-	/* Start the command */
-	err = cmd.Start()
 
+	compression := SniffCompression(head)
+	switch compression {
+	case BGZF:
+		/* Blocks are independent, so biogo can inflate them concurrently */
+		bg, err := bgzf.NewReader(buffered, threads)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		return MakeZipReader(bg, compression, bg, src), nil
+	case Gzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		/* A gzip stream can't be split, but we can at least inflate it
+		 * on its own goroutine while the caller parses records.
+		 */
+		ra := newReadAhead(gz)
+		return MakeZipReader(ra, compression, ra, gz, src), nil
+	case Zstd:
+		zr, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(threads))
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		closer := zstdCloser{zr}
+		return MakeZipReader(zr, compression, closer, src), nil
+	default:
+		return MakeZipReader(buffered, compression, src), nil
+	}
+}
+
+/*
+ * Open a FASTQ (plain, gzip, BGZF or zstd) for reading. A path of "-"
+ * reads from standard input.
+ */
+func FastZipReader(path string) (*ZipReader, error) {
+	if path == "-" {
+		return NewZipReader(io.NopCloser(os.Stdin))
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	zr, err := NewZipReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return zr, nil
+}
+
+/* zstd.Decoder.Close has no return value, adapt it to io.Closer */
+type zstdCloser struct {
+	d *zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.d.Close()
+	return nil
+}
+
+/*
+ * A readAhead pulls fixed size chunks out of a slow reader on a separate
+ * goroutine so that decompression overlaps with whoever is consuming it.
+ */
+type readAhead struct {
+	chunks  chan []byte
+	free    chan []byte
+	done    chan struct{}
+	current []byte
+	spare   []byte
+	err     error
+}
+
+const (
+	readAheadChunk  = 1 << 20
+	readAheadChunks = 4
+)
+
+func newReadAhead(src io.Reader) *readAhead {
+	ra := &readAhead{
+		chunks: make(chan []byte, readAheadChunks),
+		free:   make(chan []byte, readAheadChunks+1),
+		done:   make(chan struct{}),
+	}
+	for range readAheadChunks + 1 {
+		ra.free <- make([]byte, readAheadChunk)
+	}
+	go ra.fill(src)
+	return ra
+}
 
-	/* Make a reader that will return data with no short reads from
-	 * gzip's stdout */
-	return MakeZipReader(stdout, cmd), nil
+func (ra *readAhead) fill(src io.Reader) {
+	defer close(ra.chunks)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		case <-ra.done:
+			return
+		}
+		n, err := io.ReadFull(src, buf[:cap(buf)])
+		if n > 0 {
+			select {
+			case ra.chunks <- buf[:n]:
+			case <-ra.done:
+				return
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			ra.err = err
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if len(ra.current) == 0 {
+		if ra.spare != nil {
+			ra.free <- ra.spare
+			ra.spare = nil
+		}
+		chunk, ok := <-ra.chunks
+		if !ok {
+			/* fill has returned, so reading err is race free */
+			return 0, ra.err
+		}
+		ra.current = chunk
+		ra.spare = chunk
+	}
+	n := copy(p, ra.current)
+	ra.current = ra.current[n:]
+	return n, nil
+}
+
+func (ra *readAhead) Close() error {
+	select {
+	case <-ra.done:
+	default:
+		close(ra.done)
+	}
+	return nil
 }
@@ -146,6 +146,22 @@ func GoBwaLoadReference(path string) *GoBwaReference {
 	return &GoBwaReference{BWTData:(unsafe.Pointer)(ref), contigTids: contigTids}
 }
 
+/*
+Build the BWA index files (<prefix>.bwt, .pac, .ann, .amb and .sa) for a
+FASTA, the equivalent of "bwa index -p prefix fasta".
+*/
+func GoBwaIndex(fasta string, prefix string) error {
+	c_fasta := C.CString(fasta)
+	defer C.free(unsafe.Pointer(c_fasta))
+	c_prefix := C.CString(prefix)
+	defer C.free(unsafe.Pointer(c_prefix))
+
+	if C.bwa_idx_build(c_fasta, c_prefix, 0, -1) != 0 {
+		return fmt.Errorf("bwa index of %s failed", fasta)
+	}
+	return nil
+}
+
 func GoBwaAllocSettings() *GoBwaSettings {
 	var s GoBwaSettings
 	s.Settings = (unsafe.Pointer)(C.mem_opt_init())
@@ -381,8 +397,6 @@ func InterpretChain(ref *GoBwaReference, chn *C.mem_chain_t) Chain {
 	contig_ptr := (uintptr(unsafe.Pointer(contigs.anns)) + contig_id*unsafe.Sizeof(*contigs.anns))
 
 	contig := (*C.bntann1_t)(unsafe.Pointer(contig_ptr))
-	log.Printf("what is it that we want %v %v %v ", chn, *chn)
-	log.Printf("CONTIG PTR: %v %v %v %v", contig, contig.offset, contig.name, contig.anno)
 
 	if chn.pos < contigs.l_pac {
 		res.Offset = int64(chn.pos - contig.offset)
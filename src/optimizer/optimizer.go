@@ -3,47 +3,252 @@
 package optimizer
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"slices"
 )
 
-
+/*
+ * A model that is improved a move at a time. GenerateMove proposes a move,
+ * makes it if accept_move agrees given the model's log probability before
+ * and after, and reports whether the model changed.
+ */
 type Optimizable interface {
-	GenerateMove(accept_move func(log_p_curr float64, log_p_next float64) bool) Optimizable
+	GenerateMove(accept_move func(log_p_curr float64, log_p_next float64) bool) (Optimizable, bool)
+}
+
+/* A way of searching for the most probable state of a model */
+type Strategy interface {
+	Optimize(current_model Optimizable) Optimizable
 }
 
-func Optimize(current_model Optimizable, start_temp float64, temperature_steps int, steps_per_temp int) Optimizable {
-	var seed int64 = 1
-	var random = rand.New(rand.NewSource(seed))
-	temp_steps := GetExponentialTemperatureSteps(start_temp, temperature_steps)
+/*
+ * Count the proposals in a row that changed nothing. Once there are patience
+ * of them the model has converged (never, if patience is 0).
+ */
+func converged(idle *int, moved bool, patience int) bool {
+	if moved {
+		*idle = 0
+		return false
+	}
+	*idle++
+	return patience > 0 && *idle >= patience
+}
+
+/*
+ * Hill climbing: only moves that raise the log probability are made.
+ */
+type Greedy struct {
+	Steps    int
+	Patience int
+}
 
-	for temp_step := 0; temp_step < temperature_steps; temp_step++ {
+func (g Greedy) Optimize(current_model Optimizable) Optimizable {
+	idle := 0
+	for step := 0; step < g.Steps; step++ {
+		var moved bool
+		current_model, moved = current_model.GenerateMove(acceptImprovement)
+		if converged(&idle, moved, g.Patience) {
+			break
+		}
+	}
+	return current_model
+}
+
+func acceptImprovement(log_p_curr float64, log_p_next float64) bool {
+	return log_p_next > log_p_curr
+}
+
+/*
+ * Simulated annealing with the Metropolis criterion, cooling exponentially
+ * from StartTemp to EndTemp over TemperatureSteps temperatures with
+ * StepsPerTemp moves proposed at each.
+ */
+type Anneal struct {
+	StartTemp        float64
+	EndTemp          float64
+	TemperatureSteps int
+	StepsPerTemp     int
+	Seed             int64
+	Patience         int
+}
+
+func (a Anneal) Optimize(current_model Optimizable) Optimizable {
+	var random = rand.New(rand.NewSource(a.Seed))
+	temp_steps := GetExponentialTemperatureSteps(a.StartTemp, a.EndTemp, a.TemperatureSteps)
+
+	idle := 0
+	for temp_step := 0; temp_step < len(temp_steps); temp_step++ {
 		accept_move_func := getMoveAcceptanceFunc(temp_steps[temp_step], random)
-		for step_in_temp := 0; step_in_temp < steps_per_temp; step_in_temp++ {
-			current_model = current_model.GenerateMove(accept_move_func)
+		for step_in_temp := 0; step_in_temp < a.StepsPerTemp; step_in_temp++ {
+			var moved bool
+			current_model, moved = current_model.GenerateMove(accept_move_func)
+			if converged(&idle, moved, a.Patience) {
+				return current_model
+			}
 		}
 	}
 	return current_model
 }
 
+/*
+ * The Metropolis criterion: a move that doesn't lower the log probability is
+ * always taken, and one that lowers it by d with probability exp(-d/temp).
+ * The comparison is made in log space, so it holds however large d is.
+ */
 func getMoveAcceptanceFunc(temp float64, random *rand.Rand) func(log_p_curr float64, log_p_next float64) bool {
 	return func(log_p_curr float64, log_p_next float64) bool {
-		uniform_rand := random.Float64()
-		pc := log_p_curr - math.Max(log_p_curr, log_p_next) // having some problems with numerical stability so cheating this way, TODO fix this
-		pn := log_p_next - math.Max(log_p_curr, log_p_next)
-		return math.Exp(-(math.Exp(pc)-math.Exp(pn))/temp) > uniform_rand
+		delta := log_p_next - log_p_curr
+		if delta >= 0 {
+			return true
+		}
+		if math.IsNaN(delta) || temp <= 0 {
+			return false
+		}
+		return math.Log(random.Float64()) < delta/temp
 	}
 }
 
-func GetExponentialTemperatureSteps(start_temp float64, total_steps int) []float64 {
-	//epsilon := 0.001
+/* Temperatures falling geometrically from start_temp to end_temp */
+func GetExponentialTemperatureSteps(start_temp float64, end_temp float64, total_steps int) []float64 {
 	log_start := math.Log(start_temp)
-	log_end := math.Log(0.000000000001) //math.Log(epsilon)
+	log_end := math.Log(end_temp)
 	temps := make([]float64, total_steps)
-	step := (log_end - log_start) / float64(total_steps)
+	step := 0.0
+	if total_steps > 1 {
+		step = (log_end - log_start) / float64(total_steps-1)
+	}
 
 	for i := 0; i < total_steps; i++ {
 		temps[i] = math.Exp(log_start + (step * float64(i)))
 	}
 	return temps
 }
+
+/*
+ * A model that can be solved exactly by choosing which of its parts to keep.
+ * Bound must never be below the Score of any choice of parts within allowed.
+ * Both return false when no state uses only those parts.
+ */
+type Subsettable interface {
+	Optimizable
+	Parts() int
+	/* Upper bound on the log probability of any state using only allowed parts */
+	Bound(allowed []bool) (float64, bool)
+	/* Log probability of the best state the model finds using only kept parts */
+	Score(keep []bool) (float64, bool)
+	/* Put the model in the state that Score found for keep */
+	Apply(keep []bool) Optimizable
+}
+
+/*
+ * Exhaustive search over which parts to keep, skipping any branch whose
+ * bound can't beat the best state found so far. Models that don't support
+ * it, or have more than MaxParts parts, are handed to Fallback.
+ */
+type BranchAndBound struct {
+	MaxParts int
+	Fallback Strategy
+}
+
+func (b BranchAndBound) Optimize(current_model Optimizable) Optimizable {
+	model, ok := current_model.(Subsettable)
+	if !ok || model.Parts() > b.MaxParts {
+		return b.Fallback.Optimize(current_model)
+	}
+
+	parts := model.Parts()
+	allowed := make([]bool, parts)
+	for i := range allowed {
+		allowed[i] = true
+	}
+	best := math.Inf(-1)
+	var best_keep []bool
+
+	var search func(part int)
+	search = func(part int) {
+		if part == parts {
+			if score, ok := model.Score(allowed); ok && score > best {
+				best = score
+				best_keep = slices.Clone(allowed)
+			}
+			return
+		}
+		/* Keep the part first; then drop it, if that could still do better */
+		search(part + 1)
+		allowed[part] = false
+		if bound, ok := model.Bound(allowed); ok && bound > best {
+			search(part + 1)
+		}
+		allowed[part] = true
+	}
+	search(0)
+
+	if best_keep == nil {
+		return b.Fallback.Optimize(current_model)
+	}
+	return model.Apply(best_keep)
+}
+
+/* Names of the strategies, for Settings.Strategy */
+var Strategies = []string{"greedy", "anneal", "exact"}
+
+/* Full passes over the model made by the greedy strategy */
+const greedySweeps = 8
+
+/*
+ * Options for picking and tuning a strategy. Steps are counted in sweeps,
+ * one move proposed for each part of the model.
+ */
+type Settings struct {
+	Strategy         string
+	Seed             int64
+	StartTemp        float64
+	EndTemp          float64
+	TemperatureSteps int
+	SweepsPerTemp    int
+	/* Most parts the exact strategy takes on; bigger models are solved greedily */
+	ExactMaxParts int
+	/* Stop once a whole sweep makes no move */
+	EarlyStop bool
+}
+
+func (s Settings) Check() error {
+	if !slices.Contains(Strategies, s.Strategy) {
+		return fmt.Errorf("unknown optimizer %q (expected greedy, anneal or exact)", s.Strategy)
+	}
+	if s.StartTemp <= 0 || s.EndTemp <= 0 || s.EndTemp > s.StartTemp {
+		return fmt.Errorf("annealing temperatures must be positive, and the end temperature at most the start temperature")
+	}
+	if s.TemperatureSteps < 1 || s.SweepsPerTemp < 1 {
+		return fmt.Errorf("annealing needs at least 1 temperature step and 1 sweep per temperature")
+	}
+	if s.ExactMaxParts < 0 {
+		return fmt.Errorf("the exact optimizer's size limit can't be negative")
+	}
+	return nil
+}
+
+/* The strategy to optimize a model of the given number of parts with */
+func (s Settings) ForSize(parts int) Strategy {
+	patience := 0
+	if s.EarlyStop {
+		patience = parts
+	}
+	greedy := Greedy{Steps: greedySweeps * parts, Patience: patience}
+	switch s.Strategy {
+	case "anneal":
+		return Anneal{
+			StartTemp:        s.StartTemp,
+			EndTemp:          s.EndTemp,
+			TemperatureSteps: s.TemperatureSteps,
+			StepsPerTemp:     s.SweepsPerTemp * parts,
+			Seed:             s.Seed,
+			Patience:         patience,
+		}
+	case "exact":
+		return BranchAndBound{MaxParts: s.ExactMaxParts, Fallback: greedy}
+	}
+	return greedy
+}
@@ -0,0 +1,177 @@
+package optimizer
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMoveAcceptance(t *testing.T) {
+	tests := []struct {
+		name       string
+		temp       float64
+		curr, next float64
+		want       bool
+	}{
+		{"improvement", 1, -10, -5, true},
+		{"no change", 1, -10, -10, true},
+		{"improvement at zero temperature", 0, -10, -5, true},
+		{"from impossible", 1, math.Inf(-1), -5, true},
+		{"huge loss", 1, 0, -1e300, false},
+		{"huge loss at high temperature", 1e6, 1e300, -1e300, false},
+		{"to impossible", 1e6, -5, math.Inf(-1), false},
+		{"loss at zero temperature", 0, -10, -10.001, false},
+		{"NaN next", 1, -10, math.NaN(), false},
+		{"NaN current", 1, math.NaN(), -10, false},
+		{"impossible to impossible", 1, math.Inf(-1), math.Inf(-1), false},
+	}
+	for _, test := range tests {
+		accept := getMoveAcceptanceFunc(test.temp, rand.New(rand.NewSource(1)))
+		/* The random draw mustn't matter for any of these */
+		for draw := 0; draw < 100; draw++ {
+			if got := accept(test.curr, test.next); got != test.want {
+				t.Errorf("%s: accept(%g, %g) at temperature %g = %v, want %v", test.name, test.curr, test.next, test.temp, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMoveAcceptanceRate(t *testing.T) {
+	/* A loss of 1 at temperature 1 is taken with probability 1/e */
+	accept := getMoveAcceptanceFunc(1, rand.New(rand.NewSource(1)))
+	taken := 0
+	for draw := 0; draw < 100000; draw++ {
+		if accept(0, -1) {
+			taken++
+		}
+	}
+	if rate := float64(taken) / 100000; math.Abs(rate-math.Exp(-1)) > 0.01 {
+		t.Errorf("a loss of 1 at temperature 1 was taken %.3f of the time, want %.3f", rate, math.Exp(-1))
+	}
+}
+
+func TestExponentialTemperatureSteps(t *testing.T) {
+	tests := []struct {
+		start, end float64
+		steps      int
+	}{
+		{10, 0.1, 1},
+		{10, 0.1, 2},
+		{10, 0.1, 5},
+		{1, 1, 3},
+		{1000, 0.001, 100},
+	}
+	for _, test := range tests {
+		temps := GetExponentialTemperatureSteps(test.start, test.end, test.steps)
+		if len(temps) != test.steps {
+			t.Errorf("%g to %g in %d steps: got %d temperatures", test.start, test.end, test.steps, len(temps))
+			continue
+		}
+		if math.Abs(temps[0]-test.start) > 1e-9*test.start {
+			t.Errorf("%g to %g in %d steps: starts at %g", test.start, test.end, test.steps, temps[0])
+		}
+		if test.steps > 1 && math.Abs(temps[test.steps-1]-test.end) > 1e-9*test.end {
+			t.Errorf("%g to %g in %d steps: ends at %g", test.start, test.end, test.steps, temps[test.steps-1])
+		}
+		for i := 1; i < len(temps); i++ {
+			/* Each step cools by the same factor */
+			if ratio := temps[i] / temps[i-1]; math.Abs(ratio-temps[1]/temps[0]) > 1e-9 || ratio > 1 {
+				t.Errorf("%g to %g in %d steps: step %d goes from %g to %g", test.start, test.end, test.steps, i, temps[i-1], temps[i])
+			}
+		}
+	}
+}
+
+/*
+ * Parts with a value each and a value for each pair kept together, where at
+ * least one part has to be kept
+ */
+type subsetStub struct {
+	value []float64
+	pair  [][]float64
+	kept  []bool
+}
+
+func newSubsetStub(random *rand.Rand, parts int) *subsetStub {
+	s := &subsetStub{value: make([]float64, parts), pair: make([][]float64, parts)}
+	for i := range s.value {
+		s.value[i] = random.NormFloat64()
+		s.pair[i] = make([]float64, parts)
+		for j := 0; j < i; j++ {
+			s.pair[i][j] = random.NormFloat64()
+		}
+	}
+	return s
+}
+
+func (s *subsetStub) GenerateMove(accept_move func(float64, float64) bool) (Optimizable, bool) {
+	return s, false
+}
+
+func (s *subsetStub) Parts() int { return len(s.value) }
+
+func (s *subsetStub) sum(keep []bool, positive bool) (float64, bool) {
+	total, any := 0.0, false
+	for i := range s.value {
+		if !keep[i] {
+			continue
+		}
+		any = true
+		terms := []float64{s.value[i]}
+		for j := 0; j < i; j++ {
+			if keep[j] {
+				terms = append(terms, s.pair[i][j])
+			}
+		}
+		for _, term := range terms {
+			if !positive || term > 0 {
+				total += term
+			}
+		}
+	}
+	return total, any
+}
+
+func (s *subsetStub) Bound(allowed []bool) (float64, bool) { return s.sum(allowed, true) }
+
+func (s *subsetStub) Score(keep []bool) (float64, bool) { return s.sum(keep, false) }
+
+func (s *subsetStub) Apply(keep []bool) Optimizable {
+	s.kept = append([]bool(nil), keep...)
+	return s
+}
+
+func TestBranchAndBoundFindsOptimum(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		stub := newSubsetStub(rand.New(rand.NewSource(seed)), 8)
+
+		/* Every non-empty subset */
+		best := math.Inf(-1)
+		keep := make([]bool, stub.Parts())
+		for subset := 1; subset < 1<<stub.Parts(); subset++ {
+			for i := range keep {
+				keep[i] = subset&(1<<i) != 0
+			}
+			score, _ := stub.Score(keep)
+			best = math.Max(best, score)
+		}
+
+		BranchAndBound{MaxParts: 8, Fallback: Greedy{}}.Optimize(stub)
+		if stub.kept == nil {
+			t.Errorf("seed %d: no state applied", seed)
+			continue
+		}
+		if got, _ := stub.Score(stub.kept); math.Abs(got-best) > 1e-9 {
+			t.Errorf("seed %d: kept %v scoring %g, want the optimum %g", seed, stub.kept, got, best)
+		}
+	}
+}
+
+func TestBranchAndBoundFallback(t *testing.T) {
+	stub := newSubsetStub(rand.New(rand.NewSource(1)), 8)
+	BranchAndBound{MaxParts: 7, Fallback: Greedy{}}.Optimize(stub)
+	if stub.kept != nil {
+		t.Errorf("a model with more than MaxParts parts was solved exactly")
+	}
+}
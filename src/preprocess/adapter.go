@@ -0,0 +1,218 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"fmt"
+	"log"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/* Well-known adapters that can be given to --adapter by name */
+var adapterPresets = map[string]string{
+	"truseq":  "AGATCGGAAGAGC",
+	"nextera": "CTGTCTCTTATACACATCT",
+}
+
+const (
+	/* The shortest R1/R2 overlap believed to be the insert rather than chance */
+	minInsertOverlap = 30
+	/* The fewest bases of an adapter at the very end of a read that get trimmed */
+	minAdapterOverlap = 3
+	/* At most one mismatch per this many compared bases */
+	basesPerMismatch = 10
+)
+
+/*
+Bases trimmed off R1 and R2 are kept, in read order, in these tags (with
+their qualities in the Y tags) so the reads can be put back together.
+*/
+var trimmedTags = [2]sam.Tag{sam.NewTag("X1"), sam.NewTag("X2")}
+var trimmedQualTags = [2]sam.Tag{sam.NewTag("Y1"), sam.NewTag("Y2")}
+
+/*
+Tally of the read pairs the adapter trimmer looked at.
+*/
+type TrimStats struct {
+	Pairs int
+	/* Insert shorter than the reads, found from where R1 and R2 overlap */
+	Overlap int
+	/* An adapter or linker sequence found in one of the reads */
+	Adapter int
+	/* Bases trimmed off R1 and R2 */
+	Bases [2]int
+	/* Left with a read shorter than the minimum length, and dropped */
+	Dropped int
+}
+
+func (s *TrimStats) Log() {
+	if s.Pairs == 0 {
+		return
+	}
+	pct := func(n int) float64 { return 100 * float64(n) / float64(s.Pairs) }
+	log.Printf("Adapter trimming: %d pairs trimmed by overlap (%.1f%%), %d by adapter sequence (%.1f%%), %d R1 and %d R2 bases removed, %d pairs dropped as too short (%.1f%%)",
+		s.Overlap, pct(s.Overlap), s.Adapter, pct(s.Adapter), s.Bases[0], s.Bases[1], s.Dropped, pct(s.Dropped))
+}
+
+/*
+Trims read-through adapter and leftover linker sequence off the 3' end of
+read pairs. When the insert is shorter than the reads, R1 and the reverse
+complement of R2 overlap over the whole insert and everything after it is
+adapter, whatever its sequence; otherwise the given adapter and linker
+sequences are looked for in each read, including a partial copy running
+off its end. Pairs with a read left shorter than minLength are dropped.
+*/
+type AdapterTrimmer struct {
+	adapters  [][]byte
+	overlap   bool
+	minLength int
+	Stats     TrimStats
+}
+
+/*
+Make a trimmer for the given adapter sequences (or preset names) that,
+if overlap is set, also detects read-through from the pair overlap, and
+drops pairs with a read trimmed to fewer than minLength bases.
+*/
+func NewAdapterTrimmer(adapters []string, overlap bool, minLength int) (*AdapterTrimmer, error) {
+	if minLength < 1 {
+		return nil, fmt.Errorf("the minimum read length after trimming must be at least 1, not %d", minLength)
+	}
+	t := &AdapterTrimmer{overlap: overlap, minLength: minLength}
+	for _, adapter := range adapters {
+		if preset, ok := adapterPresets[strings.ToLower(adapter)]; ok {
+			adapter = preset
+		}
+		adapter = strings.ToUpper(adapter)
+		if adapter == "" || strings.Trim(adapter, "ACGTN") != "" {
+			return nil, fmt.Errorf("adapter %q is neither a DNA sequence nor one of truseq, nextera", adapter)
+		}
+		t.adapters = append(t.adapters, []byte(adapter))
+	}
+	return t, nil
+}
+
+func complementBase(base byte) byte {
+	switch base {
+	case 'A', 'a':
+		return 'T'
+	case 'C', 'c':
+		return 'G'
+	case 'G', 'g':
+		return 'C'
+	case 'T', 't':
+		return 'A'
+	}
+	return 'N'
+}
+
+/*
+Length of an insert shorter than both reads, found as the shortest
+stretch over which R1 matches the reverse complement of R2, or 0.
+*/
+func insertLength(read1, read2 []byte) int {
+	longest := min(len(read1), len(read2))
+	for length := minInsertOverlap; length < longest; length++ {
+		allowed := length / basesPerMismatch
+		mismatches := 0
+		for i := 0; i < length && mismatches <= allowed; i++ {
+			if read1[i] != complementBase(read2[length-1-i]) {
+				mismatches++
+			}
+		}
+		if mismatches <= allowed {
+			return length
+		}
+	}
+	return 0
+}
+
+/* Where the earliest of the adapters starts in the read, or the read length */
+func (t *AdapterTrimmer) adapterStart(read []byte) int {
+	for start := 0; start+minAdapterOverlap <= len(read); start++ {
+		for _, adapter := range t.adapters {
+			length := min(len(adapter), len(read)-start)
+			allowed := length / basesPerMismatch
+			mismatches := 0
+			for i := 0; i < length && mismatches <= allowed; i++ {
+				if read[start+i] != adapter[i] {
+					mismatches++
+				}
+			}
+			if mismatches <= allowed {
+				return start
+			}
+		}
+	}
+	return len(read)
+}
+
+/* Cut a read down to length, keeping what was cut in the mate's tags */
+func trimRead(record *fastqreader.FastQRecord, mate int, length int) {
+	seq, qual := &record.Read1, &record.ReadQual1
+	if mate == 2 {
+		seq, qual = &record.Read2, &record.ReadQual2
+	}
+	if length >= len(*seq) {
+		return
+	}
+	trimmed, trimmedQual := string((*seq)[length:]), string((*qual)[min(length, len(*qual)):])
+	*seq, *qual = (*seq)[:length], (*qual)[:min(length, len(*qual))]
+
+	var tags []sam.Aux
+	for _, aux := range record.Tags {
+		/* Bases trimmed earlier come after these ones */
+		switch aux.Tag() {
+		case trimmedTags[mate-1]:
+			trimmed += fmt.Sprint(aux.Value())
+		case trimmedQualTags[mate-1]:
+			trimmedQual += fmt.Sprint(aux.Value())
+		default:
+			tags = append(tags, aux)
+		}
+	}
+	seqTag, _ := sam.NewAux(trimmedTags[mate-1], trimmed)
+	qualTag, _ := sam.NewAux(trimmedQualTags[mate-1], trimmedQual)
+	record.Tags = tags
+	withTag(record, seqTag)
+	withTag(record, qualTag)
+}
+
+/*
+Trim a standardized read pair. Returns false if a read was left too short
+to keep, in which case the pair should be dropped.
+*/
+func (t *AdapterTrimmer) Trim(record *fastqreader.FastQRecord) bool {
+	t.Stats.Pairs++
+	len1, len2 := len(record.Read1), len(record.Read2)
+	trimmed := false
+	if t.overlap {
+		if length := insertLength(record.Read1, record.Read2); length > 0 {
+			t.Stats.Overlap++
+			trimRead(record, 1, length)
+			trimRead(record, 2, length)
+			trimmed = true
+		}
+	}
+	if !trimmed && len(t.adapters) > 0 {
+		start1, start2 := t.adapterStart(record.Read1), t.adapterStart(record.Read2)
+		if start1 < len1 || start2 < len2 {
+			t.Stats.Adapter++
+			trimRead(record, 1, start1)
+			trimRead(record, 2, start2)
+			trimmed = true
+		}
+	}
+	if !trimmed {
+		return true
+	}
+	t.Stats.Bases[0] += len1 - len(record.Read1)
+	t.Stats.Bases[1] += len2 - len(record.Read2)
+	/* Reads that were already short are left alone; only trimming drops a pair */
+	if len(record.Read1) < min(t.minLength, len1) || len(record.Read2) < min(t.minLength, len2) {
+		t.Stats.Dropped++
+		return false
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/* One lettered, numbered part of a beadtag, such as the A01 of A01C05B12D93 */
+type beadtagSegment struct {
+	letter byte
+	/* Number of digits the segment is written with */
+	width int
+	/* Highest segment number the kit has; 0 never is one */
+	max int
+}
+
+/*
+The layout of a haplotagging-style beadtag, written like "A2:96,C2:96,B2:96,D2:96":
+for each segment, in the order it appears in the barcode, its letter, its
+number of digits and optionally the highest number it goes up to (every
+number the digits can hold, if not given). A segment is valid when its
+number is between 1 and that maximum.
+*/
+type BeadtagSchema struct {
+	spec     string
+	segments []beadtagSegment
+	re       *regexp.Regexp
+}
+
+/* The classic haplotagging beadtag, AxxCxxBxxDxx */
+const DefaultBeadtagSchema = "A2,C2,B2,D2"
+
+var defaultBeadtagSchema = mustParseBeadtagSchema(DefaultBeadtagSchema)
+
+/* Optional tag listing the letters of the segments that made a beadtag invalid */
+var xfTag = sam.NewTag("XF")
+
+func ParseBeadtagSchema(spec string) (*BeadtagSchema, error) {
+	s := &BeadtagSchema{spec: spec}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		layout, maxText, hasMax := strings.Cut(part, ":")
+		if len(layout) < 2 || layout[0] < 'A' || layout[0] > 'Z' {
+			return nil, fmt.Errorf("beadtag schema %q: expected a segment like A2 or A2:96, found %q", spec, part)
+		}
+		segment := beadtagSegment{letter: layout[0]}
+		for _, other := range s.segments {
+			if other.letter == segment.letter {
+				return nil, fmt.Errorf("beadtag schema %q: segment %c is given twice", spec, segment.letter)
+			}
+		}
+		width, err := strconv.Atoi(layout[1:])
+		if err != nil || width < 1 || width > 9 {
+			return nil, fmt.Errorf("beadtag schema %q: %q is not a number of digits between 1 and 9", spec, layout[1:])
+		}
+		segment.width = width
+		segment.max, _ = strconv.Atoi(strings.Repeat("9", width))
+		if hasMax {
+			max, err := strconv.Atoi(maxText)
+			if err != nil || max < 1 || len(maxText) > width {
+				return nil, fmt.Errorf("beadtag schema %q: %q is not a highest number that fits in %d digits", spec, maxText, width)
+			}
+			segment.max = max
+		}
+		s.segments = append(s.segments, segment)
+		fmt.Fprintf(&pattern, "%c(\\d{%d})", segment.letter, segment.width)
+	}
+	pattern.WriteString("$")
+	s.re = regexp.MustCompile(pattern.String())
+	return s, nil
+}
+
+func mustParseBeadtagSchema(spec string) *BeadtagSchema {
+	s, err := ParseBeadtagSchema(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+/* Is the barcode laid out like the schema, whatever its segment numbers? */
+func (s *BeadtagSchema) Match(barcode []byte) bool {
+	return s.re.Match(barcode)
+}
+
+/*
+Letters of the segments whose numbers are 0 or past the schema's maximum.
+A barcode that isn't laid out like the schema at all fails every segment.
+*/
+func (s *BeadtagSchema) FailedSegments(barcode string) []byte {
+	var failed []byte
+	match := s.re.FindStringSubmatch(barcode)
+	for i, segment := range s.segments {
+		if match == nil {
+			failed = append(failed, segment.letter)
+			continue
+		}
+		number, _ := strconv.Atoi(match[i+1])
+		if number < 1 || number > segment.max {
+			failed = append(failed, segment.letter)
+		}
+	}
+	return failed
+}
+
+/* Write segment numbers, in schema order, as a beadtag */
+func (s *BeadtagSchema) Format(numbers []int) string {
+	var barcode strings.Builder
+	for i, segment := range s.segments {
+		fmt.Fprintf(&barcode, "%c%0*d", segment.letter, segment.width, numbers[i])
+	}
+	return barcode.String()
+}
+
+/*
+Qualities for each character of a beadtag decoded from index reads, the
+first two segments from the start and end of I1 and the last two from I2:
+every character of a segment gets the lowest quality of the length bases it
+was read from. nil if the schema doesn't have four segments or the index
+reads are too short.
+*/
+func (s *BeadtagSchema) segmentQuality(index [2][]byte, length int) []byte {
+	if len(s.segments) != 4 || length < 1 {
+		return nil
+	}
+	var qual []byte
+	for i, segment := range s.segments {
+		read := index[i/2]
+		if len(read) < length {
+			return nil
+		}
+		bases := read[:length]
+		if i%2 == 1 {
+			bases = read[len(read)-length:]
+		}
+		qual = append(qual, bytes.Repeat([]byte{slices.Min(bases)}, 1+segment.width)...)
+	}
+	return qual
+}
+
+/* The segment with the given letter, or nil */
+func (s *BeadtagSchema) segment(letter byte) *beadtagSegment {
+	for i := range s.segments {
+		if s.segments[i].letter == letter {
+			return &s.segments[i]
+		}
+	}
+	return nil
+}
+
+/* Add an XF:Z tag with the letters of the segments that failed */
+func tagFailedSegments(record *fastqreader.FastQRecord, failed []byte) {
+	if len(failed) == 0 || hasTag(record.Tags, xfTag) {
+		return
+	}
+	xf, _ := sam.NewAux(xfTag, string(failed))
+	withTag(record, xf)
+}
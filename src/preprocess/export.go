@@ -0,0 +1,172 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/* A registered format that can be exported to, by name */
+func findExporter(name string) (Format, error) {
+	var names []string
+	for _, f := range formats {
+		if _, ok := f.(Exporter); !ok {
+			continue
+		}
+		if f.Name() == strings.ToLower(name) {
+			return f, nil
+		}
+		names = append(names, f.Name())
+	}
+	return nil, fmt.Errorf("can't export to %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+/* Format one half of a read pair with the given name and tags */
+func appendNativeRecord(buf []byte, name string, tags []sam.Aux, record *fastqreader.FastQRecord, mate int) []byte {
+	seq, qual := record.Read1, record.ReadQual1
+	if mate == 2 {
+		seq, qual = record.Read2, record.ReadQual2
+	}
+
+	buf = append(buf, '@')
+	buf = append(buf, name...)
+	buf = append(buf, '/', byte('0'+mate))
+	if record.ReadGroupId != "" {
+		buf = append(buf, "\tRG:Z:"...)
+		buf = append(buf, record.ReadGroupId...)
+	}
+	for _, tag := range tags {
+		buf = append(buf, '\t')
+		buf = append(buf, fastqreader.FormatTag(tag)...)
+	}
+	for _, tag := range record.MateTags[mate-1] {
+		buf = append(buf, '\t')
+		buf = append(buf, fastqreader.FormatTag(tag)...)
+	}
+	buf = append(buf, '\n')
+	buf = append(buf, seq...)
+	buf = append(buf, "\n+\n"...)
+	buf = append(buf, qual...)
+	buf = append(buf, '\n')
+	return buf
+}
+
+/*
+Convert standard-format FASTQ (interleaved when r2 is empty) back into a
+format's own layout, written to <prefix>.R1.fq.gz and <prefix>.R2.fq.gz.
+The inverse of fastqStandardize: standardizing the output again gives back
+the input, except that validity comes from the barcode itself. Returns the
+number of read pairs written and how many of them had a VX:i that
+disagrees with what the format makes of their barcode.
+*/
+func fastqExport(r1, r2, prefix string, format Format) (int, int, error) {
+	exporter := format.(Exporter)
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fqr.Close()
+
+	outR1, outR2, err := createPairedGzipOutput(prefix+".R1.fq.gz", prefix+".R2.fq.gz")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	const chunkSize = 1 << 20
+	var record fastqreader.FastQRecord
+	var total, disagree int
+	chunkR1 := make([]byte, 0, chunkSize)
+	chunkR2 := make([]byte, 0, chunkSize)
+	for {
+		err = fqr.ReadOneLine(&record)
+		if err != nil {
+			break
+		}
+		var name string
+		var tags []sam.Aux
+		name, tags, err = exporter.ExportRecord(record)
+		if err != nil {
+			break
+		}
+		total++
+		if record.Valid != (len(record.Barcode) > 0 && format.Validate(string(record.Barcode))) {
+			disagree++
+		}
+		chunkR1 = appendNativeRecord(chunkR1, name, tags, &record, 1)
+		chunkR2 = appendNativeRecord(chunkR2, name, tags, &record, 2)
+		if len(chunkR1) >= chunkSize || len(chunkR2) >= chunkSize {
+			outR1.Write(chunkR1)
+			outR2.Write(chunkR2)
+			chunkR1 = make([]byte, 0, chunkSize)
+			chunkR2 = make([]byte, 0, chunkSize)
+		}
+	}
+	outR1.Write(chunkR1)
+	outR2.Write(chunkR2)
+
+	errR1 := outR1.Close()
+	errR2 := outR2.Close()
+	if err != io.EOF {
+		return 0, 0, err
+	}
+	if errR1 != nil {
+		return 0, 0, errR1
+	}
+	if errR2 != nil {
+		return 0, 0, errR2
+	}
+	return total, disagree, nil
+}
+
+/*
+The "arachne export" subcommand
+*/
+func Export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	var prefix string
+	var to string
+
+	flags.StringVar(&prefix, "output", "exported", "Prefix for the output files")
+	flags.StringVar(&prefix, "o", "exported", "Prefix for the output files")
+	flags.StringVar(&to, "to", "", "Format to convert to: haplotagging, stlfr or tellseq")
+	flags.StringVar(&to, "t", "", "Format to convert to: haplotagging, stlfr or tellseq")
+
+	flags.Usage = func() {
+		printPairedUsage("export --to <format> <options>")
+		fmt.Fprint(os.Stderr, "\nConvert standard-format FASTQ back into the layout of a linked-read platform, for tools that expect it.")
+		fmt.Fprint(os.Stderr, "\nStandardizing the output gives back the input.\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-t\033[0m/\033[35;1m--to\033[0m\n\tFormat to convert to: \033[92;1mhaplotagging\033[0m (\033[92;1mBX:Z\033[0m tag), \033[92;1mstlfr\033[0m (\033[92;1m#x_y_z\033[0m) or \033[92;1mtellseq\033[0m (\033[92;1m:BARCODE\033[0m) \033[90;1m(required)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-o\033[0m/\033[35;1m--output\033[0m\n\tPrefix for the output files, written as <prefix>.R1.fq.gz and <prefix>.R2.fq.gz \033[90;1m(default: exported)\033[0m\n")
+	}
+
+	flags.Parse(args)
+	input_r1, input_r2 := pairedInputArgs(flags)
+	if to == "" {
+		fmt.Fprint(os.Stderr, "\033[31;1mError:\033[0m --to is required\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	format, err := findExporter(to)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+
+	total, disagree, err := fastqExport(input_r1, input_r2, prefix, format)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	log.Printf("Exported %d read pairs to %s format", total, format.Name())
+	if disagree > 0 {
+		log.Printf("\033[33;1mWarning:\033[0m %d read pairs have a VX:i that %s barcodes can't express; standardizing the output will judge them by their barcode", disagree, format.Name())
+	}
+	fmt.Println(prefix + ".R1.fq.gz")
+	fmt.Println(prefix + ".R2.fq.gz")
+}
@@ -0,0 +1,104 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* The uncompressed contents of a gzipped FASTQ */
+func readGzipFastq(t *testing.T, path string) []byte {
+	source, err := fastqreader.FastZipReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(source); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+/* Write R1 and R2 of a format's own FASTQ, with the read header lines given */
+func writeNativeFastq(t *testing.T, dir string, headers []string) (string, string) {
+	var r1, r2 bytes.Buffer
+	for i, header := range headers {
+		fmt.Fprintf(&r1, "@%s\nACGTACGTAC%06d\n+\nIIIIIIIIIIIIIIII\n", fmt.Sprintf(header, 1), i)
+		fmt.Fprintf(&r2, "@%s\nTTGCATGCAA%06d\n+\nJJJJJJJJJJJJJJJJ\n", fmt.Sprintf(header, 2), i)
+	}
+	path1, path2 := filepath.Join(dir, "native.R1.fq"), filepath.Join(dir, "native.R2.fq")
+	if err := os.WriteFile(path1, r1.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path2, r2.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path1, path2
+}
+
+/*
+Standardize a format's own FASTQ, export it back to the format and
+standardize that again: both standard files should be the same.
+*/
+func TestExportRoundTrip(t *testing.T) {
+	tests := []struct {
+		format  Format
+		headers []string
+	}{
+		{haplotaggingFormat{defaultBeadtagSchema}, []string{
+			"read1/%d BX:Z:A01C02B03D04",
+			"read2/%d BX:Z:A01C02B03D04\tRG:Z:lane1",
+			"read3/%d BX:Z:A00C12B33D96",
+			"read4/%d BX:Z:A96C01B01D01\tMI:i:7",
+			"read5/%d",
+		}},
+		{stlfrFormat{}, []string{
+			"read1#12_345_1067/%d",
+			"read2#12_345_1067/%d\tRG:Z:lane1",
+			"read3#0_345_1067/%d",
+			"read4#1_1_1/%d\tMI:i:7",
+			"read5/%d",
+		}},
+		{tellseqFormat{}, []string{
+			"read1:ACGTACGTACGTACGTAC/%d",
+			"read2:ACGTACGTACGTACGTAC/%d\tRG:Z:lane1",
+			"read3:ACGTACGTNCGTACGTAC/%d",
+			"read4:TTTTACGTACGTACGTAC/%d\tMI:i:7",
+			"read5/%d",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.format.Name(), func(t *testing.T) {
+			dir := t.TempDir()
+			r1, r2 := writeNativeFastq(t, dir, test.headers)
+			options := standardizeOptions{Format: test.format}
+
+			std1, std2, err := fastqStandardize(r1, r2, filepath.Join(dir, "first"), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total, disagree, err := fastqExport(std1, std2, filepath.Join(dir, "exported"), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != len(test.headers) || disagree != 0 {
+				t.Errorf("exported %d read pairs (%d with a disagreeing VX:i), want %d (0)", total, disagree, len(test.headers))
+			}
+			again1, again2, err := fastqStandardize(filepath.Join(dir, "exported.R1.fq.gz"), filepath.Join(dir, "exported.R2.fq.gz"), filepath.Join(dir, "again"), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, paths := range [][2]string{{std1, again1}, {std2, again2}} {
+				want, got := readGzipFastq(t, paths[0]), readGzipFastq(t, paths[1])
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s after the round trip:\n%s\nwant:\n%s", filepath.Base(paths[1]), got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"fmt"
+	"regexp"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/*
+A linked-read chemistry that standardize knows how to recognize and convert.
+Supporting a new chemistry means implementing this and calling RegisterFormat.
+*/
+type Format interface {
+	/* Short lowercase name used in logs and error messages */
+	Name() string
+	/* Does this record look like it came from this chemistry? */
+	Detect(record fastqreader.FastQRecord) bool
+	/* Pull the barcode out of a record, returning it along with the read name minus any barcode decoration */
+	ExtractBarcode(record fastqreader.FastQRecord) (string, string)
+	/* Is the barcode a real one, as opposed to a placeholder for an undetermined barcode? */
+	Validate(barcode string) bool
+}
+
+/*
+Implemented by formats whose records say themselves whether their barcode
+is valid, so that it isn't judged from the barcode alone.
+*/
+type RecordValidator interface {
+	ValidateRecord(record fastqreader.FastQRecord) bool
+}
+
+/*
+Implemented by formats that keep the barcode in the reads themselves, to
+take it back out once it has been extracted.
+*/
+type ReadTrimmer interface {
+	TrimReads(record *fastqreader.FastQRecord)
+}
+
+/*
+Implemented by formats that know the base qualities of the barcode, which
+are kept in a QX:Z tag.
+*/
+type BarcodeQualifier interface {
+	BarcodeQuality(record fastqreader.FastQRecord) []byte
+}
+
+/*
+Implemented by formats whose barcodes are decoded from bases rather than
+being the bases themselves, to give each character of a barcode the
+quality of the bases it was decoded from.
+*/
+type BarcodeCharQualifier interface {
+	BarcodeCharQuality(record fastqreader.FastQRecord) []byte
+}
+
+/*
+Implemented by formats that standard-format reads can be converted back
+into: the read name and tags that carry the record's barcode the way the
+format itself would.
+*/
+type Exporter interface {
+	ExportRecord(record fastqreader.FastQRecord) (string, []sam.Aux, error)
+}
+
+/*
+Implemented by formats whose barcodes are made of separately numbered
+segments, to tell which segments (by letter) made a barcode invalid.
+*/
+type SegmentChecker interface {
+	FailedSegments(barcode string) []byte
+}
+
+/* Registered formats, in the order ties are broken */
+var formats []Format
+
+/* Below this fraction of sampled records no format is considered detected */
+const minFormatConfidence = 0.5
+
+/* Add a format to those findFastqFormat considers */
+func RegisterFormat(format Format) {
+	formats = append(formats, format)
+}
+
+/* The names of every registered format */
+func FormatNames() []string {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = f.Name()
+	}
+	return names
+}
+
+func init() {
+	RegisterFormat(standardFormat{})
+	RegisterFormat(haplotaggingFormat{defaultBeadtagSchema})
+	RegisterFormat(stlfrFormat{})
+	RegisterFormat(tellseqFormat{})
+}
+
+/* Split a barcode off the end of a read name with a regex whose first group is the barcode */
+func barcodeFromName(re *regexp.Regexp, name string) (string, string) {
+	match := re.FindStringSubmatchIndex(name)
+	if match == nil {
+		return "", name
+	}
+	return name[match[2]:match[3]], name[:match[0]]
+}
+
+/*
+Put a barcode back on the end of a read name, after sep, checking that
+barcodeFromName would take the same barcode back off.
+*/
+func nameWithBarcode(re *regexp.Regexp, sep string, record fastqreader.FastQRecord) (string, []sam.Aux, error) {
+	if len(record.Barcode) == 0 {
+		return record.ReadInfo, record.Tags, nil
+	}
+	name := record.ReadInfo + sep + string(record.Barcode)
+	if barcode, _ := barcodeFromName(re, name); barcode != string(record.Barcode) {
+		return "", nil, fmt.Errorf("read %q: barcode %q can't be written into the read name", record.ReadInfo, record.Barcode)
+	}
+	return name, record.Tags, nil
+}
+
+var bxTag = sam.NewTag("BX")
+var bxRe = regexp.MustCompile(`(?:^|\s)BX:Z:(\S+)`)
+var vxRe = regexp.MustCompile(`(?:^|\s)VX:i:([01])(?:\s|$)`)
+
+/*
+Already standard: BX:Z and VX:i tags in the header. Listed first so that
+it wins ties with chemistries whose barcodes are also kept in BX:Z.
+*/
+type standardFormat struct{}
+
+func (standardFormat) Name() string { return "standard" }
+
+func (standardFormat) Detect(record fastqreader.FastQRecord) bool {
+	return bxRe.MatchString(record.Comment) && vxRe.MatchString(record.Comment)
+}
+
+func (standardFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	return string(record.Barcode), record.ReadInfo
+}
+
+/* Any barcode could be valid; which ones are is carried by VX:i (see ValidateRecord) */
+func (standardFormat) Validate(barcode string) bool {
+	return barcode != ""
+}
+
+func (standardFormat) ValidateRecord(record fastqreader.FastQRecord) bool {
+	return record.Valid && len(record.Barcode) > 0
+}
+
+/* haplotagging: BX:Z beadtags laid out like the schema (AxxCxxBxxDxx by default) without a VX:i tag */
+type haplotaggingFormat struct {
+	schema *BeadtagSchema
+}
+
+/* haplotagging data whose beadtags follow a schema other than the default one */
+func NewHaplotaggingFormat(schema *BeadtagSchema) Format {
+	return haplotaggingFormat{schema}
+}
+
+func (haplotaggingFormat) Name() string { return "haplotagging" }
+
+func (f haplotaggingFormat) Detect(record fastqreader.FastQRecord) bool {
+	return f.schema.Match(record.Barcode)
+}
+
+func (haplotaggingFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	return string(record.Barcode), record.ReadInfo
+}
+
+/* a haplotagging beadtag is invalid if any of its segments is 00 or past the kit's last well */
+func (f haplotaggingFormat) Validate(barcode string) bool {
+	return len(f.schema.FailedSegments(barcode)) == 0
+}
+
+func (f haplotaggingFormat) FailedSegments(barcode string) []byte {
+	return f.schema.FailedSegments(barcode)
+}
+
+/*
+Demultiplexers write the index reads a beadtag was decoded from in RX:Z
+and their qualities in QX:Z, I1 and I2 joined by a '+' or '-'. Each
+segment is taken to be read from half of its index read.
+*/
+func (f haplotaggingFormat) BarcodeCharQuality(record fastqreader.FastQRecord) []byte {
+	var rx, qx string
+	for _, aux := range record.Tags {
+		switch aux.Tag() {
+		case rxTag:
+			rx = fmt.Sprint(aux.Value())
+		case qxTag:
+			qx = fmt.Sprint(aux.Value())
+		}
+	}
+	sep := strings.IndexAny(rx, "+-")
+	if sep < 0 || len(qx) != len(rx) {
+		return nil
+	}
+	i1, i2 := qx[:sep], qx[sep+1:]
+	return f.schema.segmentQuality([2][]byte{[]byte(i1), []byte(i2)}, min(len(i1), len(i2))/2)
+}
+
+/* Back into a BX:Z tag, without the VX:i that would make it standard */
+func (f haplotaggingFormat) ExportRecord(record fastqreader.FastQRecord) (string, []sam.Aux, error) {
+	if len(record.Barcode) == 0 {
+		return record.ReadInfo, record.Tags, nil
+	}
+	if !f.schema.Match(record.Barcode) {
+		return "", nil, fmt.Errorf("read %q: barcode %q is not a haplotagging beadtag", record.ReadInfo, record.Barcode)
+	}
+	bx, _ := sam.NewAux(bxTag, string(record.Barcode))
+	return record.ReadInfo, append([]sam.Aux{bx}, record.Tags...), nil
+}
+
+var stlfrRe = regexp.MustCompile(`#([0-9]+_[0-9]+_[0-9]+)$`)
+var stlfrInvalidRe = regexp.MustCompile(`^0_|_0_|_0$`)
+
+/* stLFR: read name ends in #x_y_z, where any 0 segment is an undetermined barcode */
+type stlfrFormat struct{}
+
+func (stlfrFormat) Name() string { return "stlfr" }
+
+func (stlfrFormat) Detect(record fastqreader.FastQRecord) bool {
+	return stlfrRe.MatchString(record.ReadInfo)
+}
+
+func (stlfrFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	return barcodeFromName(stlfrRe, record.ReadInfo)
+}
+
+func (stlfrFormat) Validate(barcode string) bool {
+	return !stlfrInvalidRe.MatchString(barcode)
+}
+
+func (stlfrFormat) ExportRecord(record fastqreader.FastQRecord) (string, []sam.Aux, error) {
+	return nameWithBarcode(stlfrRe, "#", record)
+}
+
+var tellseqRe = regexp.MustCompile(`:([ATCGN]+)$`)
+
+/* TELLseq: read name ends in :ATCGN..., barcodes with an N are undetermined */
+type tellseqFormat struct{}
+
+func (tellseqFormat) Name() string { return "tellseq" }
+
+func (tellseqFormat) Detect(record fastqreader.FastQRecord) bool {
+	return tellseqRe.MatchString(record.ReadInfo)
+}
+
+func (tellseqFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	return barcodeFromName(tellseqRe, record.ReadInfo)
+}
+
+func (tellseqFormat) Validate(barcode string) bool {
+	return !strings.Contains(barcode, "N")
+}
+
+func (tellseqFormat) ExportRecord(record fastqreader.FastQRecord) (string, []sam.Aux, error) {
+	return nameWithBarcode(tellseqRe, ":", record)
+}
@@ -0,0 +1,192 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Extend an exact sequence -> number lookup with every sequence one mismatch
+away from exactly one entry. Sequences one mismatch from several entries
+map to -1.
+*/
+func oneMismatchLookup(exact map[string]int) map[string]int {
+	lookup := map[string]int{}
+	for seq, number := range exact {
+		for i := range seq {
+			for _, base := range "ACGTN" {
+				if byte(base) == seq[i] {
+					continue
+				}
+				neighbour := seq[:i] + string(base) + seq[i+1:]
+				if _, ok := exact[neighbour]; ok {
+					continue
+				}
+				if other, ok := lookup[neighbour]; ok && other != number {
+					lookup[neighbour] = -1
+				} else {
+					lookup[neighbour] = number
+				}
+			}
+		}
+	}
+	for seq, number := range exact {
+		lookup[seq] = number
+	}
+	return lookup
+}
+
+/*
+TELLseq data as shipped by the vendor, with the barcode in its own I1 FASTQ
+instead of the read name. The I1 qualities go along as a QX:Z tag, which
+whitelist correction uses to break ties.
+*/
+type tellseqIndexFormat struct{}
+
+func (tellseqIndexFormat) Name() string { return "tellseq (I1)" }
+
+func (tellseqIndexFormat) Detect(record fastqreader.FastQRecord) bool {
+	return len(record.Index) > 0
+}
+
+func (tellseqIndexFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	if len(record.Index) == 0 {
+		return "", record.ReadInfo
+	}
+	return string(record.Index[0]), record.ReadInfo
+}
+
+func (tellseqIndexFormat) Validate(barcode string) bool {
+	return tellseqFormat{}.Validate(barcode)
+}
+
+func (tellseqIndexFormat) BarcodeQuality(record fastqreader.FastQRecord) []byte {
+	if len(record.IndexQual) == 0 {
+		return nil
+	}
+	return record.IndexQual[0]
+}
+
+/*
+Raw haplotagging data, with the beadtag still encoded in the I1 and I2
+index reads. The beadtag schema has four segments (AxxCxxBxxDxx by
+default): I1 holds the first segment then the second and I2 the third
+then the fourth, each looked up (allowing one mismatch) in a segment list
+and written out as the schema says. A segment that can't be decoded
+becomes 0, which makes the beadtag invalid.
+*/
+type haplotaggingIndexFormat struct {
+	schema *BeadtagSchema
+	/* Segment letter to a lookup of its sequences and their numbers */
+	segments map[byte]map[string]int
+	/* Length of every segment sequence */
+	length int
+}
+
+/*
+Load a haplotagging segment list, one "<segment><number><TAB><sequence>"
+line per segment (e.g. "A01	ACGTAC"), for beadtags laid out like schema.
+*/
+func LoadHaplotaggingIndexFormat(path string, schema *BeadtagSchema) (*haplotaggingIndexFormat, error) {
+	if len(schema.segments) != 4 {
+		return nil, fmt.Errorf("beadtag schema %q: decoding index reads needs 4 segments, 2 in each of I1 and I2", schema.spec)
+	}
+	source, err := fastqreader.FastZipReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	exact := map[byte]map[string]int{}
+	length := 0
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields[0]) < 2 {
+			return nil, fmt.Errorf("%s: expected a segment like A01 and its sequence, found %q", path, scanner.Text())
+		}
+		segment := schema.segment(fields[0][0])
+		if segment == nil {
+			return nil, fmt.Errorf("%s: segment %s isn't in the beadtag schema %q", path, fields[0], schema.spec)
+		}
+		number, err := strconv.Atoi(fields[0][1:])
+		if err != nil || number <= 0 || number > segment.max {
+			return nil, fmt.Errorf("%s: %q is not a segment number between 1 and %d", path, fields[0], segment.max)
+		}
+		seq := strings.ToUpper(fields[1])
+		if length == 0 {
+			length = len(seq)
+		} else if len(seq) != length {
+			return nil, fmt.Errorf("%s: segment %s is %d bp but earlier segments are %d bp", path, fields[0], len(seq), length)
+		}
+		if exact[fields[0][0]] == nil {
+			exact[fields[0][0]] = map[string]int{}
+		}
+		exact[fields[0][0]][seq] = number
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	f := &haplotaggingIndexFormat{schema: schema, segments: map[byte]map[string]int{}, length: length}
+	for _, segment := range schema.segments {
+		if len(exact[segment.letter]) == 0 {
+			return nil, fmt.Errorf("%s: no %c segments", path, segment.letter)
+		}
+		f.segments[segment.letter] = oneMismatchLookup(exact[segment.letter])
+	}
+	return f, nil
+}
+
+func (*haplotaggingIndexFormat) Name() string { return "haplotagging (I1/I2)" }
+
+func (*haplotaggingIndexFormat) Detect(record fastqreader.FastQRecord) bool {
+	return len(record.Index) == 2
+}
+
+/* Number of the segment at the start (or end) of an index read, 0 if it isn't in the list */
+func (f *haplotaggingIndexFormat) decode(letter byte, index []byte, atEnd bool) int {
+	if len(index) < f.length {
+		return 0
+	}
+	seq := index[:f.length]
+	if atEnd {
+		seq = index[len(index)-f.length:]
+	}
+	number := f.segments[letter][string(seq)]
+	if number < 0 {
+		return 0
+	}
+	return number
+}
+
+func (f *haplotaggingIndexFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	if len(record.Index) != 2 {
+		return "", record.ReadInfo
+	}
+	segments := f.schema.segments
+	return f.schema.Format([]int{
+		f.decode(segments[0].letter, record.Index[0], false), f.decode(segments[1].letter, record.Index[0], true),
+		f.decode(segments[2].letter, record.Index[1], false), f.decode(segments[3].letter, record.Index[1], true)}), record.ReadInfo
+}
+
+func (f *haplotaggingIndexFormat) BarcodeCharQuality(record fastqreader.FastQRecord) []byte {
+	if len(record.IndexQual) != 2 {
+		return nil
+	}
+	return f.schema.segmentQuality([2][]byte{record.IndexQual[0], record.IndexQual[1]}, f.length)
+}
+
+func (f *haplotaggingIndexFormat) Validate(barcode string) bool {
+	return len(f.schema.FailedSegments(barcode)) == 0
+}
+
+func (f *haplotaggingIndexFormat) FailedSegments(barcode string) []byte {
+	return f.schema.FailedSegments(barcode)
+}
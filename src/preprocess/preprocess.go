@@ -3,29 +3,11 @@ package preprocess
 import (
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 )
 
-func validateSamtools() error {
-	_, err := exec.LookPath("samtools")
-	if err != nil {
-		return fmt.Errorf("samtools not found in PATH: %v", err)
-	}
-
-	// check if samtools is working by running version command
-	cmd := exec.Command("samtools", "--version")
-	_, err = cmd.Output()
-	if err != nil {
-		return fmt.Errorf("samtools appears to be installed but not working properly: %v", err)
-	}
-	return nil
-}
-
 func FileExists(path string, filetype string) bool {
 	absfile, err := filepath.Abs(path)
 	if err != nil {
@@ -39,124 +21,88 @@ func FileExists(path string, filetype string) bool {
 	return true
 }
 
-func runSamtoolsPipelineWithPipes(inputR1, inputR2, barcode_tag, threads string) error {
-	outputR1 := barcode_tag + "_sort." + filepath.Base(inputR1)
-	outputR2 := barcode_tag + "_sort." + filepath.Base(inputR2)
-
-	// Step 1: samtools import
-	importCmd := exec.Command("samtools", "import", "-T", "*", "-1", inputR1, "-2", inputR2)
-	//importCmd.Stderr = &stderr
-	// Step 2: samtools sort
-	sortCmd := exec.Command("samtools", "sort", "-@", threads, "-O", "SAM", "-t", barcode_tag)
-
-	// Step 3: samtools fastq
-	fastqCmd := exec.Command("samtools", "fastq", "-c", "4", "-T", "*", "-1", outputR1, "-2", outputR2)
-
-	// Connect the pipes
-	importOutput, err := importCmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create import stdout pipe: %v", err)
-	}
-
-	sortInput, err := sortCmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create sort stdin pipe: %v", err)
-	}
-
-	sortOutput, err := sortCmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create sort stdout pipe: %v", err)
-	}
-
-	fastqInput, err := fastqCmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create fastq stdin pipe: %v", err)
-	}
-
-	// Start all commands
-	if err := importCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start import command: %v", err)
-	}
-
-	if err := sortCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start sort command: %v", err)
-	}
-
-	if err := fastqCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start fastq command: %v", err)
-	}
-
-	// Copy data between pipes
-	go func() {
-		defer sortInput.Close()
-		io.Copy(sortInput, importOutput)
-	}()
-
-	go func() {
-		defer fastqInput.Close()
-		io.Copy(fastqInput, sortOutput)
-	}()
-
-	// Wait for all commands to complete
-	if err := importCmd.Wait(); err != nil {
-		return fmt.Errorf("import command failed: %v", err)
-	}
+/*
+Print the usage lines of a subcommand that takes forward and reverse reads or
+interleaved reads. command is what comes before the files, e.g.
+"validate <options>".
+*/
+func printPairedUsage(command string) {
+	fmt.Fprintf(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne %s sample.R1.fq sample.R2.fq\n", command)
+	fmt.Fprintf(os.Stderr, "       arachne %s sample.interleaved.fq\n", command)
+}
 
-	if err := sortCmd.Wait(); err != nil {
-		return fmt.Errorf("sort command failed: %v", err)
+/*
+The input files of a subcommand that takes forward and reverse reads or
+interleaved reads, with r2 empty for interleaved input. Prints the usage and
+exits unless there are one or two of them and they can be read.
+*/
+func pairedInputArgs(flags *flag.FlagSet) (string, string) {
+	if flags.NArg() != 1 && flags.NArg() != 2 {
+		if flags.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 1 or 2 positional arguments (interleaved, or forward and reverse reads) are required, but %d were given\n", flags.NArg())
+		}
+		flags.Usage()
+		os.Exit(1)
 	}
 
-	if err := fastqCmd.Wait(); err != nil {
-		return fmt.Errorf("fastq command failed: %v", err)
+	input_r1 := flags.Arg(0)
+	FileExists(input_r1, "FASTQ")
+	input_r2 := ""
+	if flags.NArg() == 2 {
+		input_r2 = flags.Arg(1)
+		FileExists(input_r2, "FASTQ")
 	}
-
-	return nil
+	return input_r1, input_r2
 }
 
-func preprocess() {
-	var input_r1 string
-	var input_r2 string
+/*
+The "arachne preprocess" subcommand: sort paired-end reads by barcode
+*/
+func Preprocess(args []string) {
+	flags := flag.NewFlagSet("preprocess", flag.ExitOnError)
+	var prefix string
 	var barcode_tag string
 	var threads int
+	var memory int
+	var tempDir string
 
-	flag.StringVar(&barcode_tag, "tag", "BX", "Which SAM tag has the barcode to sort by")
-	flag.IntVar(&threads, "threads", 4, "Number of sorting threads")
+	flags.StringVar(&prefix, "output", "sorted", "Prefix for the output files")
+	flags.StringVar(&prefix, "o", "sorted", "Prefix for the output files")
+	flags.StringVar(&barcode_tag, "tag", "BX", "Which SAM tag has the barcode to sort by")
+	flags.IntVar(&threads, "threads", 4, "Number of sorting threads")
+	flags.IntVar(&memory, "memory", 2048, "Memory (in MB) to use for sorting")
+	flags.StringVar(&tempDir, "tmpdir", "", "Directory for temporary sorted runs")
 
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne preprocess <options> sample.R1.fq sample.R2.fq\n")
-		fmt.Fprint(os.Stderr, "\nPreprocess a set of paired-end FASTQ files to sort them by barcode. Requires samtools to be present in the PATH.\n")
+	flags.Usage = func() {
+		printPairedUsage("preprocess <options>")
+		fmt.Fprint(os.Stderr, "\nSort a set of paired-end FASTQ files by barcode, writing gzipped standard-format FASTQ.\n")
 
 		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-o\033[0m/\033[35;1m--output\033[0m\n\tPrefix for the output files, written as <prefix>.R1.fq.gz and <prefix>.R2.fq.gz \033[90;1m(default: sorted)\033[0m")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m--threads\033[0m\n\tNumber of sorting threads \033[90;1m(default: 4)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--memory\033[0m\n\tMemory (in MB) to use for sorting \033[90;1m(default: 2048)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--tmpdir\033[0m\n\tDirectory for temporary sorted runs \033[90;1m(default: system temp dir)\033[0m")
 		fmt.Fprint(os.Stderr, "\n  \033[35;1m--tag\033[0m\n\tWhich SAM tag has the barcode to sort by \033[90;1m(default: BX)\033[0m\n")
 	}
 
-	flag.Parse()
-	if flag.NArg() != 2 {
-		if flag.NArg() != 0 {
-			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 2 positional arguments (forward and reverse reads) are required, but %d were given\n", flag.NArg())
-		}
-		flag.Usage()
-		os.Exit(1)
+	flags.Parse(args)
+	input_r1, input_r2 := pairedInputArgs(flags)
+	if threads < 1 {
+		threads = 1
 	}
 
-	input_r1 = flag.Arg(0)
-	FileExists(input_r1, "FASTQ")
-	input_r2 = flag.Arg(1)
-	FileExists(input_r2, "FASTQ")
-
-	// Validate samtools is available
-	if err := validateSamtools(); err != nil {
-		log.Printf("Error: %v\n", err)
-		return
+	out_r1 := prefix + ".R1.fq.gz"
+	out_r2 := prefix + ".R2.fq.gz"
+	// a run per sorting thread can be in memory while the next one is read
+	config := SortConfig{
+		Tag:          barcode_tag,
+		TempDir:      tempDir,
+		MemoryBudget: (int64(memory) << 20) / int64(threads+1),
+		Threads:      threads,
 	}
-	err := runSamtoolsPipelineWithPipes(
-		input_r1,
-		input_r2,
-		barcode_tag,
-		strconv.Itoa((threads)),
-	)
-	if err != nil {
-		log.Printf("Error: %v\n", err)
+	if err := sortByBarcode(input_r1, input_r2, out_r1, out_r2, config); err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
 	}
+	fmt.Println(out_r1)
+	fmt.Println(out_r2)
 }
@@ -0,0 +1,195 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* What a stretch of read bases is */
+type segmentKind byte
+
+const (
+	/* Barcode: moved into BX:Z (and its qualities into QX:Z) */
+	barcodeSegment segmentKind = 'B'
+	/* Skipped: spacers, linkers and the like, dropped */
+	skipSegment segmentKind = 'S'
+	/* Template: the insert, kept as the read */
+	templateSegment segmentKind = 'T'
+)
+
+/* A stretch of a read. A length of -1 ("+") means the rest of the read */
+type readSegment struct {
+	length int
+	kind   segmentKind
+}
+
+/*
+Where the barcode is in the reads of an inline-barcode chemistry, written
+like "R1:16B7S+T,R2:+T": for each read, a list of <length><kind>
+segments, with "+" as the length of a final segment that takes the rest of
+the read. Kinds are B (barcode), S (skip) and T (template). A read that
+isn't mentioned is all template, and bases past a final fixed length
+segment are dropped. Barcode segments are joined in order, R1 first, and
+a read too short for its segments has no barcode.
+*/
+type readStructureFormat struct {
+	spec  string
+	reads [2][]readSegment
+}
+
+func ParseReadStructure(spec string) (*readStructureFormat, error) {
+	f := &readStructureFormat{spec: spec}
+	f.reads[0] = []readSegment{{-1, templateSegment}}
+	f.reads[1] = []readSegment{{-1, templateSegment}}
+
+	seen := [2]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		name, layout, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("read structure %q: expected R1:<segments> or R2:<segments>, found %q", spec, part)
+		}
+		var read int
+		switch strings.ToUpper(name) {
+		case "R1":
+			read = 0
+		case "R2":
+			read = 1
+		default:
+			return nil, fmt.Errorf("read structure %q: unknown read %q (expected R1 or R2)", spec, name)
+		}
+		if seen[read] {
+			return nil, fmt.Errorf("read structure %q: %s is given twice", spec, name)
+		}
+		seen[read] = true
+
+		segments, err := parseSegments(layout)
+		if err != nil {
+			return nil, fmt.Errorf("read structure %q: %s: %v", spec, name, err)
+		}
+		f.reads[read] = segments
+	}
+
+	for _, segments := range f.reads {
+		for _, segment := range segments {
+			if segment.kind == barcodeSegment {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("read structure %q has no barcode (B) segment", spec)
+}
+
+/* Parse "16B7S+T" */
+func parseSegments(layout string) ([]readSegment, error) {
+	var segments []readSegment
+	for i := 0; i < len(layout); {
+		length := -1
+		if layout[i] == '+' {
+			i++
+		} else {
+			j := i
+			for j < len(layout) && layout[j] >= '0' && layout[j] <= '9' {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("expected a length or '+' at %q", layout[i:])
+			}
+			length, _ = strconv.Atoi(layout[i:j])
+			if length == 0 {
+				return nil, fmt.Errorf("segment of length 0 at %q", layout[i:])
+			}
+			i = j
+		}
+		if i == len(layout) {
+			return nil, fmt.Errorf("segment length without a kind at the end of %q", layout)
+		}
+		kind := segmentKind(layout[i] &^ 0x20)
+		if kind != barcodeSegment && kind != skipSegment && kind != templateSegment {
+			return nil, fmt.Errorf("unknown segment kind %q (expected B, S or T)", layout[i])
+		}
+		i++
+		if len(segments) > 0 && segments[len(segments)-1].length < 0 {
+			return nil, fmt.Errorf("only the last segment can be '+'")
+		}
+		segments = append(segments, readSegment{length, kind})
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no segments")
+	}
+	return segments, nil
+}
+
+/*
+Cut a read into its segments, returning the bases and qualities of each
+segment of the given kind, joined. ok is false if the read is too short.
+*/
+func cutSegments(segments []readSegment, kind segmentKind, seq, qual []byte) ([]byte, []byte, bool) {
+	var outSeq, outQual []byte
+	start := 0
+	for _, segment := range segments {
+		end := start + segment.length
+		if segment.length < 0 {
+			end = len(seq)
+		}
+		if end > len(seq) || end > len(qual) {
+			return nil, nil, false
+		}
+		if segment.kind == kind {
+			outSeq = append(outSeq, seq[start:end]...)
+			outQual = append(outQual, qual[start:end]...)
+		}
+		start = end
+	}
+	return outSeq, outQual, true
+}
+
+/* Bases and qualities of every barcode segment, R1 then R2 */
+func (f *readStructureFormat) barcode(record fastqreader.FastQRecord) ([]byte, []byte, bool) {
+	seq1, qual1, ok1 := cutSegments(f.reads[0], barcodeSegment, record.Read1, record.ReadQual1)
+	seq2, qual2, ok2 := cutSegments(f.reads[1], barcodeSegment, record.Read2, record.ReadQual2)
+	if !ok1 || !ok2 {
+		return nil, nil, false
+	}
+	return append(seq1, seq2...), append(qual1, qual2...), true
+}
+
+func (f *readStructureFormat) Name() string { return "read structure " + f.spec }
+
+/* Both reads are long enough for their fixed length segments */
+func (f *readStructureFormat) Detect(record fastqreader.FastQRecord) bool {
+	_, _, ok := f.barcode(record)
+	return ok
+}
+
+func (f *readStructureFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	seq, _, ok := f.barcode(record)
+	if !ok {
+		return "", record.ReadInfo
+	}
+	return string(seq), record.ReadInfo
+}
+
+/* Inline barcodes are sequence; an N means a base wasn't called */
+func (f *readStructureFormat) Validate(barcode string) bool {
+	return !strings.Contains(barcode, "N")
+}
+
+func (f *readStructureFormat) BarcodeQuality(record fastqreader.FastQRecord) []byte {
+	_, qual, ok := f.barcode(record)
+	if !ok {
+		return nil
+	}
+	return qual
+}
+
+/* Keep only the template segments. Reads too short for the structure are left alone */
+func (f *readStructureFormat) TrimReads(record *fastqreader.FastQRecord) {
+	if seq, qual, ok := cutSegments(f.reads[0], templateSegment, record.Read1, record.ReadQual1); ok {
+		record.Read1, record.ReadQual1 = seq, qual
+	}
+	if seq, qual, ok := cutSegments(f.reads[1], templateSegment, record.Read2, record.ReadQual2); ok {
+		record.Read2, record.ReadQual2 = seq, qual
+	}
+}
@@ -0,0 +1,420 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	sam "github.com/biogo/hts/sam"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Settings for sortByBarcode.
+*/
+type SortConfig struct {
+	/* SAM tag holding the barcode to sort by */
+	Tag string
+	/* Where sorted runs are spilled. Empty means os.TempDir() */
+	TempDir string
+	/* Approximate bytes of reads held in memory per run */
+	MemoryBudget int64
+	/* Number of runs sorted and spilled at the same time */
+	Threads int
+}
+
+/* A read pair and the barcode it sorts by */
+type keyedRecord struct {
+	key    string
+	record fastqreader.FastQRecord
+}
+
+/* Rough in-memory footprint of a record, for the memory budget */
+func recordSize(record *fastqreader.FastQRecord) int64 {
+	size := len(record.Read1) + len(record.ReadQual1) + len(record.Read2) + len(record.ReadQual2) +
+		len(record.Barcode) + len(record.ReadInfo) + len(record.ReadGroupId) + 200
+	for _, tag := range record.Tags {
+		size += len(tag) + 24
+	}
+	for _, tags := range record.MateTags {
+		for _, tag := range tags {
+			size += len(tag) + 24
+		}
+	}
+	return int64(size)
+}
+
+/* The value of the sort tag, or "" if the record doesn't have it */
+func sortKey(record *fastqreader.FastQRecord, tag sam.Tag) string {
+	if tag == sam.NewTag("BX") {
+		return string(record.Barcode)
+	}
+	for _, aux := range record.Tags {
+		if aux.Tag() == tag {
+			return fmt.Sprint(aux.Value())
+		}
+	}
+	return ""
+}
+
+/*
+Write a run as zstd interleaved FASTQ. write is handed a function to pass
+each record of the run to, in order.
+*/
+func writeRunFile(path string, write func(emit func(*fastqreader.FastQRecord) error) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buffered := bufio.NewWriterSize(file, 1<<20)
+	zw, err := zstd.NewWriter(buffered, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	err = write(func(record *fastqreader.FastQRecord) error {
+		buf = fastqreader.AppendStandardRecord(buf[:0], record, 1)
+		buf = fastqreader.AppendStandardRecord(buf, record, 2)
+		_, err := zw.Write(buf)
+		return err
+	})
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+/* Sort one run by barcode (keeping input order within a barcode) and spill it */
+func writeRun(run []keyedRecord, path string) error {
+	sort.SliceStable(run, func(i, j int) bool { return run[i].key < run[j].key })
+	return writeRunFile(path, func(emit func(*fastqreader.FastQRecord) error) error {
+		for i := range run {
+			if err := emit(&run[i].record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+Read all of input, cutting it into runs of about config.MemoryBudget bytes.
+Runs are sorted and spilled to dir by config.Threads workers while reading
+carries on. The run files are returned in input order.
+*/
+func spillSortedRuns(input *fastqreader.FastQReader, dir string, config SortConfig) ([]string, error) {
+	type job struct {
+		run  []keyedRecord
+		path string
+	}
+	jobs := make(chan job)
+	errs := make(chan error, config.Threads)
+	var workers sync.WaitGroup
+	for range config.Threads {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				if err := writeRun(j.run, j.path); err != nil {
+					errs <- err
+					/* keep draining so the reader doesn't block */
+					for range jobs {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	tag := sam.NewTag(config.Tag)
+	var paths []string
+	var run []keyedRecord
+	var size int64
+	var readErr error
+	flush := func() bool {
+		path := filepath.Join(dir, fmt.Sprintf("run_%05d.fq.zst", len(paths)))
+		paths = append(paths, path)
+		select {
+		case jobs <- job{run, path}:
+		case err := <-errs:
+			errs <- err
+			return false
+		}
+		run = nil
+		size = 0
+		return true
+	}
+	for {
+		var record fastqreader.FastQRecord
+		err := input.ReadOneLine(&record)
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		run = append(run, keyedRecord{sortKey(&record, tag), record})
+		size += recordSize(&record)
+		if size >= config.MemoryBudget && !flush() {
+			break
+		}
+	}
+	if readErr == nil && len(run) > 0 {
+		flush()
+	}
+	close(jobs)
+	workers.Wait()
+	close(errs)
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+/* One sorted run being merged: its reader and the record at its head */
+type runCursor struct {
+	reader *fastqreader.FastQReader
+	head   keyedRecord
+	/* Position of the run in the input, so equal barcodes keep input order */
+	order int
+}
+
+type runHeap []*runCursor
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].head.key != h[j].head.key {
+		return h[i].head.key < h[j].head.key
+	}
+	return h[i].order < h[j].order
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+/* Move a cursor on to the next record of its run. Returns false at the end of the run */
+func (c *runCursor) advance(tag sam.Tag) (bool, error) {
+	var record fastqreader.FastQRecord
+	err := c.reader.ReadOneLine(&record)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.head = keyedRecord{sortKey(&record, tag), record}
+	return true, nil
+}
+
+/*
+Most runs merged at once. Every run being merged holds an open file and a
+decoder, so with more runs than this they are merged in several passes.
+*/
+const maxMergeFanIn = 64
+
+/*
+Pass the records of sorted runs to emit in barcode order, records with the
+same barcode in the order of the runs they came from.
+*/
+func mergeSortedRuns(paths []string, tag sam.Tag, emit func(*fastqreader.FastQRecord) error) error {
+	h := runHeap{}
+	defer func() {
+		for _, c := range h {
+			c.reader.Close()
+		}
+	}()
+	for i, path := range paths {
+		source, err := fastqreader.FastZipReader(path)
+		if err != nil {
+			return err
+		}
+		c := &runCursor{reader: fastqreader.NewInterleavedFastQ(source), order: i}
+		ok, err := c.advance(tag)
+		if err != nil {
+			c.reader.Close()
+			return err
+		}
+		if ok {
+			h = append(h, c)
+		} else {
+			c.reader.Close()
+		}
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		c := h[0]
+		if err := emit(&c.head.record); err != nil {
+			return err
+		}
+		ok, err := c.advance(tag)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			c.reader.Close()
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+/*
+Merge runs in groups of maxMergeFanIn into new runs in dir, until there
+are few enough to merge at once. Groups are consecutive, so the merged runs
+stay in input order. The groups of a pass are merged by up to threads
+goroutines at once, each with its own maxMergeFanIn open runs. Runs are
+removed once merged.
+*/
+func mergeDownRuns(paths []string, dir string, tag sam.Tag, threads int) ([]string, error) {
+	for pass := 1; len(paths) > maxMergeFanIn; pass++ {
+		merged := make([]string, (len(paths)+maxMergeFanIn-1)/maxMergeFanIn)
+		errs := make(chan error, len(merged))
+		slots := make(chan struct{}, threads)
+		var merges sync.WaitGroup
+		for i := range merged {
+			group := paths[i*maxMergeFanIn : min((i+1)*maxMergeFanIn, len(paths))]
+			path := filepath.Join(dir, fmt.Sprintf("merge%d_%05d.fq.zst", pass, i))
+			merged[i] = path
+			slots <- struct{}{}
+			merges.Add(1)
+			go func() {
+				defer merges.Done()
+				defer func() { <-slots }()
+				err := writeRunFile(path, func(emit func(*fastqreader.FastQRecord) error) error {
+					return mergeSortedRuns(group, tag, emit)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, done := range group {
+					os.Remove(done)
+				}
+			}()
+		}
+		merges.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			return nil, err
+		}
+		log.Printf("Merged %d sorted runs into %d", len(paths), len(merged))
+		paths = merged
+	}
+	return paths, nil
+}
+
+/*
+Merge sorted runs into gzipped standard FASTQ at r1_out and r2_out, in
+passes through dir, up to threads groups at a time, if there are more than
+maxMergeFanIn of them. Each output is compressed on its own goroutine while
+the merge continues.
+*/
+func mergeRuns(paths []string, dir string, tag sam.Tag, r1_out, r2_out string, threads int) (int, error) {
+	paths, err := mergeDownRuns(paths, dir, tag, threads)
+	if err != nil {
+		return 0, err
+	}
+
+	outR1, outR2, err := createPairedGzipOutput(r1_out, r2_out)
+	if err != nil {
+		return 0, err
+	}
+
+	const chunkSize = 1 << 20
+	total := 0
+	chunkR1 := make([]byte, 0, chunkSize)
+	chunkR2 := make([]byte, 0, chunkSize)
+	err = mergeSortedRuns(paths, tag, func(record *fastqreader.FastQRecord) error {
+		chunkR1 = fastqreader.AppendStandardRecord(chunkR1, record, 1)
+		chunkR2 = fastqreader.AppendStandardRecord(chunkR2, record, 2)
+		total++
+		if len(chunkR1) >= chunkSize || len(chunkR2) >= chunkSize {
+			outR1.Write(chunkR1)
+			outR2.Write(chunkR2)
+			chunkR1 = make([]byte, 0, chunkSize)
+			chunkR2 = make([]byte, 0, chunkSize)
+		}
+		return nil
+	})
+	outR1.Write(chunkR1)
+	outR2.Write(chunkR2)
+
+	errR1 := outR1.Close()
+	errR2 := outR2.Close()
+	if err != nil {
+		return 0, err
+	}
+	if errR1 != nil {
+		return 0, errR1
+	}
+	return total, errR2
+}
+
+/*
+External merge sort of paired FASTQ (or interleaved FASTQ/uBAM when r2 is
+empty) by the barcode in config.Tag, written as gzipped standard FASTQ.
+*/
+func sortByBarcode(r1, r2, r1_out, r2_out string, config SortConfig) error {
+	if config.Threads <= 0 {
+		config.Threads = 1
+	}
+	if config.MemoryBudget <= 0 {
+		config.MemoryBudget = 1 << 30
+	}
+	if len(config.Tag) != 2 {
+		return fmt.Errorf("%q is not a two character SAM tag", config.Tag)
+	}
+
+	input, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(config.TempDir, "arachne-sort-")
+	if err != nil {
+		input.Close()
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	log.Printf("Sorting reads by %s into runs of %d MB", config.Tag, config.MemoryBudget>>20)
+	paths, err := spillSortedRuns(input, dir, config)
+	input.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Merging %d sorted runs", len(paths))
+	total, err := mergeRuns(paths, dir, sam.NewTag(config.Tag), r1_out, r2_out, config.Threads)
+	if err != nil {
+		return err
+	}
+	log.Printf("Sorted %d read pairs into %s and %s", total, r1_out, r2_out)
+	return nil
+}
@@ -0,0 +1,49 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/* Enough one-read runs that merging them takes more than one pass */
+func TestSortByBarcodeMergesInPasses(t *testing.T) {
+	const pairs = 2*maxMergeFanIn + 5
+	random := rand.New(rand.NewSource(1))
+	headers := make([]string, pairs)
+	for i := range headers {
+		headers[i] = fmt.Sprintf("read%d/%%d\tBX:Z:A%02dC01B01D01\tVX:i:1", i, random.Intn(20)+1)
+	}
+	dir := t.TempDir()
+	r1, r2 := writeNativeFastq(t, dir, headers)
+	r1_out, r2_out := filepath.Join(dir, "sorted.R1.fq.gz"), filepath.Join(dir, "sorted.R2.fq.gz")
+	config := SortConfig{Tag: "BX", TempDir: dir, MemoryBudget: 1, Threads: 4}
+	if err := sortByBarcode(r1, r2, r1_out, r2_out, config); err != nil {
+		t.Fatal(err)
+	}
+
+	sorted, err := fastqreader.OpenPairedFastQ(r1_out, r2_out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sorted.Close()
+	var record fastqreader.FastQRecord
+	last_barcode, last_read := "", -1
+	count := 0
+	for sorted.ReadOneLine(&record) == nil {
+		count++
+		read, _ := strconv.Atoi(strings.TrimPrefix(record.ReadInfo, "read"))
+		barcode := string(record.Barcode)
+		if barcode < last_barcode || (barcode == last_barcode && read < last_read) {
+			t.Fatalf("read%d (%s) sorted after read%d (%s)", read, barcode, last_read, last_barcode)
+		}
+		last_barcode, last_read = barcode, read
+	}
+	if count != pairs {
+		t.Errorf("sorted %d read pairs, want %d", count, pairs)
+	}
+}
@@ -2,296 +2,527 @@ package preprocess
 
 import (
 	"arachne/src/fastqreader"
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
-	"regexp"
+	"slices"
 	"strings"
-)
-
-// first, a sentinel function that reads the first 200 records of R1/R2 and looks to assess:
-// 1. if it's already standardized
-// 2. if not, what the fastq format type is (haplotagging, stlfr, tellseq)
 
-var bxRe = regexp.MustCompile(`BX:Z:(\S+)\s`)
-var vxRe = regexp.MustCompile(`VX:i:([01])\s`)
+	sam "github.com/biogo/hts/sam"
+	"github.com/klauspost/compress/gzip"
+)
 
-var haplotaggingRe = regexp.MustCompile(`BX:Z:(A\d{2}C\d{2}B\d{2}D\d{2})\s`)
+/*
+Sample the first 200 records of a paired-end fastq and score every registered
+format by the fraction of sampled records it recognizes. The best scoring
+format wins, ties going to whichever was registered first (so "standard"
+beats a chemistry whose barcodes happen to already be in BX:Z tags).
+Returns nil if nothing recognizes at least half of the sample.
+*/
+func findFastqFormat(r1, r2 string) (Format, float64, error) {
+	var record fastqreader.FastQRecord
+	var err error
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
 
-var stlfrRe = regexp.MustCompile(`#([0-9]+_[0-9]+_[0-9]+)\s`)
-var stlfrInvalidRe = regexp.MustCompile(`^0_|_0_|_0$`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fqr.Close()
 
-var tellseqRe = regexp.MustCompile(`:([ATCGN]+)\s`)
+	hits := make([]int, len(formats))
+	sampled := 0
+	for range 200 {
+		err := fqr.ReadOneLine(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		sampled++
+		for i, f := range formats {
+			if f.Detect(record) {
+				hits[i]++
+			}
+		}
+	}
+	if sampled == 0 {
+		return nil, 0, errors.New("no records to sample")
+	}
 
-/*Return true if the fastq record is in Standard format*/
-func isStandardized(seq_id string) bool {
-	// regex match BX:Z:*
-	bxMatches := bxRe.FindStringSubmatch(seq_id)
-	if len(bxMatches) <= 1 {
-		return false
+	var best Format
+	bestConfidence := 0.0
+	for i, f := range formats {
+		confidence := float64(hits[i]) / float64(sampled)
+		if confidence > bestConfidence {
+			best = f
+			bestConfidence = confidence
+		}
 	}
-	// regex match VX:i:[01]
-	vxMatches := vxRe.FindStringSubmatch(seq_id)
-	if len(vxMatches) > 1 {
-		return true
-	} else {
-		return false
+	if bestConfidence < minFormatConfidence {
+		return nil, bestConfidence, nil
 	}
+	return best, bestConfidence, nil
 }
 
-/*Return true if the fastq record is in haplotagging format*/
-func isHaplotagging(seq_id string) bool {
-	// regex match BX:Z:AxxCxxBxxDxx
-	bxMatches := haplotaggingRe.FindStringSubmatch(seq_id)
-	if len(bxMatches) > 1 {
-		return true
+/* Rewrite a record from some chemistry into the standard format */
+func standardizeRecord(format Format, record fastqreader.FastQRecord) fastqreader.FastQRecord {
+	var std_rec fastqreader.FastQRecord
+
+	barcode, name := format.ExtractBarcode(record)
+	std_rec.Read1 = record.Read1
+	std_rec.ReadQual1 = record.ReadQual1
+	std_rec.Read2 = record.Read2
+	std_rec.ReadQual2 = record.ReadQual2
+	std_rec.Barcode = []byte(barcode)
+	if validator, ok := format.(RecordValidator); ok {
+		std_rec.Valid = validator.ValidateRecord(record)
+	} else {
+		std_rec.Valid = barcode != "" && format.Validate(barcode)
 	}
-	return false
+	std_rec.ReadInfo = name
+	std_rec.ReadGroupId = record.ReadGroupId
+	std_rec.Tags = record.Tags
+	std_rec.MateTags = record.MateTags
+	if trimmer, ok := format.(ReadTrimmer); ok {
+		trimmer.TrimReads(&std_rec)
+	}
+	if qualifier, ok := format.(BarcodeQualifier); ok {
+		if qual := qualifier.BarcodeQuality(record); qual != nil && !hasTag(record.Tags, qxTag) {
+			qx, _ := sam.NewAux(qxTag, string(qual))
+			withTag(&std_rec, qx)
+		}
+	}
+	return std_rec
 }
 
-/*Return true if the fastq record is in stlfr format*/
-func isStlfr(seq_id string) bool {
-	// regex match BX:Z:AxxCxxBxxDxx
-	bxMatches := stlfrRe.FindStringSubmatch(seq_id)
-	if len(bxMatches) > 1 {
-		return true
+/*
+The quality of each character of a standardized record's barcode, for
+whitelist correction to break ties with, or nil if nothing says. Formats
+that decode barcodes know best; otherwise a QX:Z as long as the barcode
+holds its base qualities, whether the format added it or the input had it.
+*/
+func barcodeQuality(format Format, input, record fastqreader.FastQRecord) []byte {
+	if qualifier, ok := format.(BarcodeCharQualifier); ok {
+		if qual := qualifier.BarcodeCharQuality(input); len(qual) == len(record.Barcode) {
+			return qual
+		}
 	}
-	return false
+	for _, aux := range record.Tags {
+		if aux.Tag() == qxTag {
+			if qual := fmt.Sprint(aux.Value()); len(qual) == len(record.Barcode) {
+				return []byte(qual)
+			}
+		}
+	}
+	return nil
 }
 
-/*Return true if the fastq record is in stlfr format*/
-func isTellseq(seq_id string) bool {
-	// regex match BX:Z:AxxCxxBxxDxx
-	bxMatches := tellseqRe.FindStringSubmatch(seq_id)
-	if len(bxMatches) > 1 {
-		return true
+func hasTag(tags []sam.Aux, tag sam.Tag) bool {
+	for _, aux := range tags {
+		if aux.Tag() == tag {
+			return true
+		}
 	}
 	return false
 }
 
-/*Convert the forward-read part of a fastq record to a string and write it*/
-func writeR1FastqRecord(record fastqreader.FastQRecord, gzip_proc io.WriteCloser) error {
-	var fq_fmt string
-	
-	fq_fmt = record.ReadInfo + "/1\tBX:Z:" + string(record.Barcode) + "\tVX:i:" + record.Valid + "\n"
-	fq_fmt += "\n" + string(record.Read1) + "\n+\n" + string(record.ReadQual1) + "\n"
-
-	if _, err := gzip_proc.Write([]byte(fq_fmt)); err != nil {
-		log.Fatalf("Error writing to gzip: %v", err)
-	}
+/*
+Add a tag to a record. Its Tags may be shared with the record it was made
+from, so they're never appended to in place.
+*/
+func withTag(record *fastqreader.FastQRecord, aux sam.Aux) {
+	record.Tags = append(record.Tags[:len(record.Tags):len(record.Tags)], aux)
 }
 
-/*Convert the forward-read part of a fastq record to a string and write it*/
-func writeR2FastqRecord(record fastqreader.FastQRecord, gzip_proc io.WriteCloser) error {
-	var fq_fmt string
-
-	fq_fmt = record.ReadInfo + "/2\tBX:Z:" + string(record.Barcode) + "\tVX:i:" + record.Valid + "\n"
-	fq_fmt += "\n" + string(record.Read2) + "\n+\n" + string(record.ReadQual2) + "\n"
+/*
+Settings for fastqStandardize beyond the input and output files.
+*/
+type standardizeOptions struct {
+	/* Convert from this format rather than detecting one */
+	Format Format
+	/* Check barcodes against a whitelist */
+	Corrector *BarcodeCorrector
+	/* Index read FASTQs (I1, I2) to read alongside R1 and R2 */
+	Index []string
+	/* Add an XF:Z tag naming the beadtag segments that made a barcode invalid */
+	SegmentTag bool
+	/* Trim adapter and linker sequence off the reads */
+	Trimmer *AdapterTrimmer
+}
 
-	if _, err := gzip_proc.Write([]byte(fq_fmt)); err != nil {
-		log.Fatalf("Error writing to gzip: %v", err)
+/* Open the paired input along with any index reads */
+func openStandardizeInput(r1, r2 string, index []string) (*fastqreader.FastQReader, error) {
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return nil, err
 	}
+	for _, path := range index {
+		if err := fqr.AddIndexReads(path); err != nil {
+			fqr.Close()
+			return nil, err
+		}
+	}
+	return fqr, nil
 }
 
-
 /*
-Parse through the first 50 records of a paired-end fastq and see if it's already in standardized format.
-Standardized meaning it has a BX:Z tag and a VX:i tag. Returns early if a format is detected.
+A gzipped FASTQ being written on its own goroutine, so that R1 and R2
+compress in parallel with each other and with the reading/converting.
 */
-func findFastqFormat(r1, r2 string) (string, error) {
-	var record fastqreader.FastQRecord
-	var err error
-	fqr, err := fastqreader.OpenFastQ(r1, r2)
+type gzipOutput struct {
+	file   *os.File
+	chunks chan []byte
+	done   chan error
+}
 
+func createGzipOutput(path string) (*gzipOutput, error) {
+	file, err := os.Create(path)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	for range 200 {
-		err := fqr.ReadOneLine(&record)
-		if err != nil {
-			return "", err
+	out := &gzipOutput{file: file, chunks: make(chan []byte, 16), done: make(chan error, 1)}
+	go func() {
+		buffered := bufio.NewWriterSize(file, 1<<20)
+		gz := gzip.NewWriter(buffered)
+		var err error
+		for chunk := range out.chunks {
+			if err == nil {
+				_, err = gz.Write(chunk)
+			}
 		}
-		if isStandardized(record.ReadInfo) {
-			return "standard", nil
-		} else if isHaplotagging(record.ReadInfo) {
-			return "haplotagging", nil
-		} else if isStlfr(record.ReadInfo) {
-			return "stlfr", nil
-		} else if isTellseq(record.ReadInfo) {
-			return "tellseq", nil
+		if err == nil {
+			err = gz.Close()
 		}
-	}
-	return "unknown", nil
+		if err == nil {
+			err = buffered.Flush()
+		}
+		out.done <- err
+	}()
+	return out, nil
 }
 
-/* takes a FASTQ record that doesn't have a proper barcode and returns one with a barcode and validation */
-func standardizeFromHaplotagging(record fastqreader.FastQRecord) fastqreader.FastQRecord {
-	var std_rec fastqreader.FastQRecord
-
-	std_rec.Read1 = record.Read1
-	std_rec.ReadQual1 = record.ReadQual1
-	std_rec.Read2 = record.Read2
-	std_rec.ReadQual2 = record.ReadQual2
-	std_rec.Barcode = record.Barcode
-	std_rec.Valid = strings.Contains(string(record.Barcode), "00")
-	std_rec.ReadInfo = record.ReadInfo
-	std_rec.ReadGroupId = record.ReadGroupId
-	return std_rec
+/* queue a chunk for compression; the caller must not touch it afterwards */
+func (g *gzipOutput) Write(chunk []byte) (int, error) {
+	g.chunks <- chunk
+	return len(chunk), nil
 }
 
-func standardizeFromStlfr(record fastqreader.FastQRecord) fastqreader.FastQRecord {
-	var std_rec fastqreader.FastQRecord
-	var barcode string
-
-	// FIND THE BARCODE IN THE READ ID
-	bxMatches := stlfrRe.FindStringSubmatch(record.ReadInfo)
-	if len(bxMatches) <= 1 {
-		barcode = ""
-	} else {
-		barcode = bxMatches[1]
+func (g *gzipOutput) Close() error {
+	close(g.chunks)
+	err := <-g.done
+	if err2 := g.file.Close(); err == nil {
+		err = err2
 	}
-	std_rec.Read1 = record.Read1
-	std_rec.ReadQual1 = record.ReadQual1
-	std_rec.Read2 = record.Read2
-	std_rec.ReadQual2 = record.ReadQual2
-	std_rec.Barcode = []byte(barcode)
-	std_rec.Valid = !(len(stlfrInvalidRe.FindStringSubmatch(barcode)) > 1)
-	std_rec.ReadInfo = record.ReadInfo
-	std_rec.ReadGroupId = record.ReadGroupId
-	return std_rec
+	return err
 }
 
-func standardizeFromTellseq(record fastqreader.FastQRecord) fastqreader.FastQRecord {
-	var std_rec fastqreader.FastQRecord
-	var barcode string
-
-	// FIND THE BARCODE IN THE READ ID
-	bxMatches := tellseqRe.FindStringSubmatch(record.ReadInfo)
-	if len(bxMatches) <= 1 {
-		barcode = ""
-	} else {
-		barcode = bxMatches[1]
+/* The two outputs of a read pair, with neither left open if either fails */
+func createPairedGzipOutput(r1_out, r2_out string) (*gzipOutput, *gzipOutput, error) {
+	outR1, err := createGzipOutput(r1_out)
+	if err != nil {
+		return nil, nil, err
 	}
-	std_rec.Read1 = record.Read1
-	std_rec.ReadQual1 = record.ReadQual1
-	std_rec.Read2 = record.Read2
-	std_rec.ReadQual2 = record.ReadQual2
-	std_rec.Barcode = []byte(barcode)
-	std_rec.Valid = strings.Contains(string(record.Barcode), "N")
-	std_rec.ReadInfo = record.ReadInfo
-	std_rec.ReadGroupId = record.ReadGroupId
-	return std_rec
+	outR2, err := createGzipOutput(r2_out)
+	if err != nil {
+		outR1.Close()
+		return nil, nil, err
+	}
+	return outR1, outR2, nil
 }
 
-func fastqStandardize(r1 string, r2, string, format string) (string, string) {
-	var r1_out = "standard.R1.fq.gz"
-	var r2_out = "standard.R2.fq.gz"
-	var err error
-
-	format, err = findFastqFormat(r1, r2)
-	if err != nil {
-		log.Printf("Error opening %s and/or %s to identify file formatting. If the files are unable to be opened at this preprocessing stage, they will be unable to be read for alignment.", r1, r2)
-		os.Exit(1)
+/*
+Convert paired FASTQ from any registered linked-read format into standard-format
+gzipped FASTQ named <prefix>.R1.fq.gz and <prefix>.R2.fq.gz. Input that is
+already standard is left alone and its own paths are returned, unless there
+is a corrector to check its barcodes against a whitelist or a trimmer to
+trim its reads. The format is detected unless one is given.
+*/
+func fastqStandardize(r1, r2, prefix string, options standardizeOptions) (string, string, error) {
+	format := options.Format
+	corrector := options.Corrector
+	trimmer := options.Trimmer
+	var r1_out = prefix + ".R1.fq.gz"
+	var r2_out = prefix + ".R2.fq.gz"
+
+	var confidence float64
+	detected := format == nil
+	if detected {
+		var err error
+		format, confidence, err = findFastqFormat(r1, r2)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to identify the format of %s and %s: %v", r1, r2, err)
+		}
+		if format == nil {
+			return "", "", fmt.Errorf("input is not in a recognized linked-read format (%s)", strings.Join(FormatNames(), ", "))
+		}
 	}
 
 	// if it's already in standard format, return immediately with the original filenames
-	if format == "standard" {
-		return r1, r2
+	if format.Name() == "standard" && corrector == nil && trimmer == nil {
+		log.Println("Input is already in standard format")
+		return r1, r2, nil
 	}
 
 	// Needs to be standardized
-	log.Println("Input file standardization started")
-
-	// Create the gzip command that will write to output.gz
-	cmd_R1 := exec.Command("gzip", "-c")
-	cmd_R2 := exec.Command("gzip", "-c")
-
-	// Get the stdin pipe to write data to gzip
-	stdinR1, err := cmd_R1.StdinPipe()
-	if err != nil {
-		log.Fatal("Error creating stdin pipe:", err)
-	}
-	stdinR2, err := cmd_R2.StdinPipe()
-	if err != nil {
-		log.Fatal("Error creating stdin pipe:", err)
+	if detected {
+		log.Printf("Input file standardization started (%s format, %.0f%% of sampled records matched)", format.Name(), confidence*100)
+	} else {
+		log.Printf("Input file standardization started (%s format)", format.Name())
 	}
 
-	// Create the output files
-	outFileR1, err := os.Create(r1_out)
+	fqr, err := openStandardizeInput(r1, r2, options.Index)
 	if err != nil {
-		log.Fatal("Error creating output file:", err)
+		return "", "", err
 	}
-	outFileR2, err := os.Create(r2_out)
+	defer fqr.Close()
+
+	outR1, outR2, err := createPairedGzipOutput(r1_out, r2_out)
 	if err != nil {
-		log.Fatal("Error creating output file:", err)
+		return "", "", err
 	}
 
-	defer outFileR1.Close()
-	defer outFileR2.Close()
-
-	// Set gzip's stdout to write to the files
-	cmd_R1.Stdout = outFileR1
-	cmd_R2.Stdout = outFileR2
+	// READ TILL THE END, handing the writers ~1MB at a time
+	const chunkSize = 1 << 20
+	var record fastqreader.FastQRecord
+	var total, valid int
+	/* Invalid barcodes each beadtag segment was to blame for */
+	checker, _ := format.(SegmentChecker)
+	segmentFailures := map[byte]int{}
+	chunkR1 := make([]byte, 0, chunkSize)
+	chunkR2 := make([]byte, 0, chunkSize)
+	for {
+		err = fqr.ReadOneLine(&record)
+		if err != nil {
+			break
+		}
+		recordNew := standardizeRecord(format, record)
+		if corrector != nil {
+			corrector.Correct(&recordNew, barcodeQuality(format, record, recordNew))
+		}
+		if trimmer != nil && !trimmer.Trim(&recordNew) {
+			continue
+		}
+		total++
+		if recordNew.Valid {
+			valid++
+		} else if checker != nil {
+			failed := checker.FailedSegments(string(recordNew.Barcode))
+			for _, letter := range failed {
+				segmentFailures[letter]++
+			}
+			if options.SegmentTag {
+				tagFailedSegments(&recordNew, failed)
+			}
+		}
+		chunkR1 = fastqreader.AppendStandardRecord(chunkR1, &recordNew, 1)
+		chunkR2 = fastqreader.AppendStandardRecord(chunkR2, &recordNew, 2)
+		if len(chunkR1) >= chunkSize || len(chunkR2) >= chunkSize {
+			outR1.Write(chunkR1)
+			outR2.Write(chunkR2)
+			chunkR1 = make([]byte, 0, chunkSize)
+			chunkR2 = make([]byte, 0, chunkSize)
+		}
+	}
+	outR1.Write(chunkR1)
+	outR2.Write(chunkR2)
 
-	// Start the gzip process
-	if err := cmd_R1.Start(); err != nil {
-		log.Fatal("Error starting gzip:", err)
+	errR1 := outR1.Close()
+	errR2 := outR2.Close()
+	if err != io.EOF {
+		return "", "", err
+	}
+	if errR1 != nil {
+		return "", "", errR1
 	}
-	if err := cmd_R2.Start(); err != nil {
-		log.Fatal("Error starting gzip:", err)
+	if errR2 != nil {
+		return "", "", errR2
 	}
 
-	// Now stream data to gzip
-	go func() {
-		// Important: close stdin when done
-		defer stdinR1.Close()
-		defer stdinR2.Close()
-
-		var record fastqreader.FastQRecord
-		var recordNew fastqreader.FastQRecord
-
-		if format == "haplotagging" {
-				convertFunc := standardizeFromHaplotagging
-			} else if format == "stlfr" {
-				convertFunc := standardizeFromStlfr
-			} else {
-				convertFunc := standardizeFromTellseq
-			}
+	log.Printf("Input file standardization completed: %d read pairs, %d with valid barcodes", total, valid)
+	if corrector != nil {
+		corrector.Stats.Log()
+	}
+	if trimmer != nil {
+		trimmer.Stats.Log()
+	}
+	if len(segmentFailures) > 0 {
+		letters := make([]byte, 0, len(segmentFailures))
+		for letter := range segmentFailures {
+			letters = append(letters, letter)
+		}
+		slices.Sort(letters)
+		counts := make([]string, len(letters))
+		for i, letter := range letters {
+			counts[i] = fmt.Sprintf("%c %d", letter, segmentFailures[letter])
+		}
+		log.Printf("Invalid beadtags by failed segment: %s", strings.Join(counts, ", "))
+	}
 
-		// no need to check for error b/c file was already opened by sentinel
-		fqr, _ := fastqreader.OpenFastQ(r1, r2)
+	return r1_out, r2_out, nil
+}
 
-		// READ TILL THE END
-		for range 200 {
-			err := fqr.ReadOneLine(&record)
-			if err != nil {
-				// I THINK THIS MIGHT BE THE END OF THE FILE?
-			}
-			recordNew = convertFunc(record)
-			// WRITE R1
+/*
+The "arachne standardize" subcommand
+*/
+func Standardize(args []string) {
+	flags := flag.NewFlagSet("standardize", flag.ExitOnError)
+	var prefix string
+	var whitelist string
+	var maxDistance int
+	var metric string
+	var stlfrBarcodes string
+	var i1, i2 string
+	var segments string
+	var readStructure string
+	var beadtagSchema string
+	var segmentTag bool
+	var adapters string
+	var trimOverlap bool
+	var minLength int
+
+	flags.StringVar(&prefix, "output", "standard", "Prefix for the output files")
+	flags.StringVar(&prefix, "o", "standard", "Prefix for the output files")
+	flags.StringVar(&whitelist, "whitelist", "", "File of known barcodes, one per line, to correct barcodes against")
+	flags.StringVar(&whitelist, "w", "", "File of known barcodes, one per line, to correct barcodes against")
+	flags.IntVar(&maxDistance, "max-distance", 1, "Largest number of errors to correct in a barcode, at most 2 (with --whitelist)")
+	flags.StringVar(&metric, "distance", "hamming", "How barcode errors are counted: hamming or edit (with --whitelist)")
+	flags.StringVar(&stlfrBarcodes, "stlfr-barcodes", "", "stLFR barcode list, to decode raw stLFR reads with the barcode at the end of R2")
+	flags.StringVar(&i1, "i1", "", "I1 index read FASTQ holding the barcode (TELLseq) or beadtag segments A and C (haplotagging)")
+	flags.StringVar(&i2, "i2", "", "I2 index read FASTQ holding beadtag segments B and D (haplotagging)")
+	flags.StringVar(&segments, "haplotag-segments", "", "Haplotagging segment list, to decode beadtags from --i1 and --i2")
+	flags.StringVar(&readStructure, "read-structure", "", "Where an inline barcode is in the reads, e.g. R1:16B7S+T,R2:+T")
+	flags.StringVar(&beadtagSchema, "beadtag-schema", "", "Layout of haplotagging beadtags, e.g. A2:96,C2:96,B2:96,D2:96 (default: "+DefaultBeadtagSchema+")")
+	flags.BoolVar(&segmentTag, "segment-tag", false, "Name the beadtag segments that made a barcode invalid in an XF:Z tag")
+	flags.StringVar(&adapters, "adapter", "", "Comma-separated adapter or linker sequences (or truseq, nextera) to trim off the 3' end of reads")
+	flags.BoolVar(&trimOverlap, "trim-overlap", false, "Trim read-through adapter from pairs whose insert is shorter than the reads, found from the R1/R2 overlap")
+	flags.IntVar(&minLength, "min-length", 20, "Drop pairs with a read trimmed shorter than this (with --adapter or --trim-overlap)")
+
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "\n\033[94;1mUsage:\033[0m arachne standardize <options> sample.R1.fq sample.R2.fq\n")
+		fmt.Fprint(os.Stderr, "\nConvert haplotagging, stLFR (decoded or raw) or TELLseq paired-end FASTQ files into the standard linked-read format")
+		fmt.Fprint(os.Stderr, "\n(barcode in a \033[92;1mBX:Z\033[0m tag, validation in a \033[92;1mVX:i\033[0m tag). The format is detected automatically.\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-o\033[0m/\033[35;1m--output\033[0m\n\tPrefix for the output files, written as <prefix>.R1.fq.gz and <prefix>.R2.fq.gz \033[90;1m(default: standard)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-w\033[0m/\033[35;1m--whitelist\033[0m\n\tFile of known barcodes, one per line. Barcodes are corrected against it and only whitelisted ones are valid.\n\tTies are broken by the barcode's base qualities, from index reads, \033[35;1m--read-structure\033[0m or \033[92;1mRX:Z\033[0m/\033[92;1mQX:Z\033[0m tags")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--max-distance\033[0m\n\tLargest number of errors to correct in a barcode, at most 2 \033[90;1m(default: 1)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--distance\033[0m\n\tHow barcode errors are counted: \033[92;1mhamming\033[0m (substitutions) or \033[92;1medit\033[0m (also indels) \033[90;1m(default: hamming)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--stlfr-barcodes\033[0m\n\tstLFR barcode list (sequence and number per line). Treats the input as raw stLFR, decoding the\n\tbarcode from the last 42 bp of R2 and trimming it off")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--i1\033[0m\n\tI1 index read FASTQ. On its own it holds the barcode (TELLseq); with \033[35;1m--haplotag-segments\033[0m it holds\n\tbeadtag segments A then C")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--i2\033[0m\n\tI2 index read FASTQ holding beadtag segments B then D (haplotagging)")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--haplotag-segments\033[0m\n\tHaplotagging segment list (e.g. \033[92;1mA01 ACGTAC\033[0m per line), to decode beadtags from \033[35;1m--i1\033[0m and \033[35;1m--i2\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--read-structure\033[0m\n\tWhere an inline barcode is in the reads, as <length><kind> segments per read, e.g. \033[92;1mR1:16B7S+T,R2:+T\033[0m\n\t(B = barcode, S = skip, T = template, + = rest of the read)")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--beadtag-schema\033[0m\n\tLayout of haplotagging beadtags: a letter, number of digits and optionally the highest number for each\n\tsegment, e.g. \033[92;1mA3:384,C2:96,B2:96,D2:96\033[0m. Implies haplotagging input \033[90;1m(default: "+DefaultBeadtagSchema+")\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--segment-tag\033[0m\n\tName the beadtag segments that made a barcode invalid in an \033[92;1mXF:Z\033[0m tag (e.g. \033[92;1mXF:Z:C\033[0m)")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--adapter\033[0m\n\tComma-separated adapter or linker sequences to trim off the 3' end of reads, including partial copies at the\n\tvery end. \033[92;1mtruseq\033[0m and \033[92;1mnextera\033[0m name their adapters. Trimmed bases go in \033[92;1mX1:Z\033[0m/\033[92;1mX2:Z\033[0m, their qualities in \033[92;1mY1:Z\033[0m/\033[92;1mY2:Z\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--trim-overlap\033[0m\n\tTrim read-through adapter, whatever its sequence, from pairs whose R1 and R2 overlap over an insert shorter\n\tthan the reads")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--min-length\033[0m\n\tDrop pairs with a read trimmed to fewer bases than this, rather than write empty or tiny reads\n\t(with \033[35;1m--adapter\033[0m or \033[35;1m--trim-overlap\033[0m) \033[90;1m(default: 20)\033[0m\n")
+	}
 
-			// WRITE R2
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		if flags.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "\033[31;1mError:\033[0m 2 positional arguments (forward and reverse reads) are required, but %d were given\n", flags.NArg())
 		}
+		flags.Usage()
+		os.Exit(1)
+	}
 
-		// Example: stream some text data
-			if _, err := stdin.Write([]byte(data)); err != nil {
-				log.Printf("Error writing to gzip: %v", err)
-				return
-			}
+	input_r1 := flags.Arg(0)
+	FileExists(input_r1, "FASTQ")
+	input_r2 := flags.Arg(1)
+	FileExists(input_r2, "FASTQ")
+
+	var corrector *BarcodeCorrector
+	if whitelist != "" {
+		FileExists(whitelist, "Whitelist")
+		distanceMetric, err := ParseDistanceMetric(metric)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+		corrector, err = LoadBarcodeCorrector(whitelist, maxDistance, distanceMetric)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
 		}
 	}
 
-	// Wait for gzip to finish processing
-	if err := cmd_R1.Wait(); err != nil {
-		log.Fatal("Error waiting for gzip:", err)
+	options := standardizeOptions{Corrector: corrector, SegmentTag: segmentTag}
+	if adapters != "" || trimOverlap {
+		var sequences []string
+		if adapters != "" {
+			sequences = strings.Split(adapters, ",")
+		}
+		var err error
+		options.Trimmer, err = NewAdapterTrimmer(sequences, trimOverlap, minLength)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
 	}
-	if err := cmd_R2.Wait(); err != nil {
-		log.Fatal("Error waiting for gzip:", err)
+	schema := defaultBeadtagSchema
+	if beadtagSchema != "" {
+		var err error
+		schema, err = ParseBeadtagSchema(beadtagSchema)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+	}
+	if i1 != "" {
+		FileExists(i1, "I1 FASTQ")
+		options.Index = append(options.Index, i1)
+	}
+	if i2 != "" {
+		FileExists(i2, "I2 FASTQ")
+		options.Index = append(options.Index, i2)
+	}
+	switch {
+	case beadtagSchema != "" && (readStructure != "" || stlfrBarcodes != ""):
+		log.Fatalf("\033[31;1mError:\033[0m --beadtag-schema is only used with haplotagging input\n")
+	case readStructure != "" && (stlfrBarcodes != "" || len(options.Index) > 0):
+		log.Fatalf("\033[31;1mError:\033[0m --read-structure can't be combined with --stlfr-barcodes or index reads\n")
+	case readStructure != "":
+		structure, err := ParseReadStructure(readStructure)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+		options.Format = structure
+	case stlfrBarcodes != "" && len(options.Index) > 0:
+		log.Fatalf("\033[31;1mError:\033[0m raw stLFR keeps its barcodes in R2 and doesn't use index reads\n")
+	case stlfrBarcodes != "":
+		FileExists(stlfrBarcodes, "stLFR barcode list")
+		rawStlfr, err := LoadRawStlfrFormat(stlfrBarcodes)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+		options.Format = rawStlfr
+	case segments != "":
+		if i1 == "" || i2 == "" {
+			log.Fatalf("\033[31;1mError:\033[0m --haplotag-segments needs both --i1 and --i2\n")
+		}
+		FileExists(segments, "Haplotagging segment list")
+		haplotagging, err := LoadHaplotaggingIndexFormat(segments, schema)
+		if err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+		options.Format = haplotagging
+	case i2 != "":
+		log.Fatalf("\033[31;1mError:\033[0m --i2 is only used to decode haplotagging beadtags (with --haplotag-segments)\n")
+	case beadtagSchema != "" && i1 != "":
+		log.Fatalf("\033[31;1mError:\033[0m --beadtag-schema with index reads needs --haplotag-segments to decode them\n")
+	case i1 != "":
+		options.Format = tellseqIndexFormat{}
+	case beadtagSchema != "":
+		options.Format = NewHaplotaggingFormat(schema)
 	}
 
-	log.Println("Input file standardization completed")
-
-	return r1_out, r2_out
+	out_r1, out_r2, err := fastqStandardize(input_r1, input_r2, prefix, options)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	fmt.Println(out_r1)
+	fmt.Println(out_r2)
 }
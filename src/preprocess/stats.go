@@ -0,0 +1,320 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/* Length and quality summary of one read of the pairs */
+type ReadStats struct {
+	MinLength  int     `json:"min_length"`
+	MaxLength  int     `json:"max_length"`
+	MeanLength float64 `json:"mean_length"`
+	/* Mean Phred quality over every base */
+	MeanQuality float64 `json:"mean_quality"`
+	/* Fraction of bases at Q30 or better */
+	FractionQ30 float64 `json:"fraction_q30"`
+	/* Read length to number of reads */
+	Lengths map[int]int `json:"lengths"`
+
+	bases       int
+	qualitySum  int
+	q30Bases    int
+	lengthTotal int
+	reads       int
+}
+
+func (s *ReadStats) add(seq, qual []byte) {
+	if s.reads == 0 || len(seq) < s.MinLength {
+		s.MinLength = len(seq)
+	}
+	if len(seq) > s.MaxLength {
+		s.MaxLength = len(seq)
+	}
+	s.reads++
+	s.lengthTotal += len(seq)
+	s.Lengths[len(seq)]++
+	for _, q := range qual {
+		phred := int(q) - 33
+		s.qualitySum += phred
+		if phred >= 30 {
+			s.q30Bases++
+		}
+	}
+	s.bases += len(qual)
+}
+
+func (s *ReadStats) finish() {
+	if s.reads > 0 {
+		s.MeanLength = float64(s.lengthTotal) / float64(s.reads)
+	}
+	if s.bases > 0 {
+		s.MeanQuality = float64(s.qualitySum) / float64(s.bases)
+		s.FractionQ30 = float64(s.q30Bases) / float64(s.bases)
+	}
+}
+
+/* A barcode and how many read pairs carry it */
+type BarcodeCount struct {
+	Barcode string `json:"barcode"`
+	Reads   int    `json:"reads"`
+	Valid   bool   `json:"valid"`
+}
+
+/*
+Barcode QC for a standard-format library, gathered before aligning it.
+*/
+type BarcodeStats struct {
+	ReadPairs           int     `json:"read_pairs"`
+	ValidPairs          int     `json:"valid_pairs"`
+	InvalidPairs        int     `json:"invalid_pairs"`
+	NoBarcodePairs      int     `json:"no_barcode_pairs"`
+	FractionValid       float64 `json:"fraction_valid"`
+	ValidBarcodes       int     `json:"valid_barcodes"`
+	InvalidBarcodes     int     `json:"invalid_barcodes"`
+	MeanReadsPerBarcode float64 `json:"mean_reads_per_valid_barcode"`
+	/* Read pairs per valid barcode to number of valid barcodes */
+	ReadsPerBarcode map[int]int `json:"reads_per_barcode"`
+	/* Barcodes with fewer read pairs than this aren't worth running RFA on */
+	MinReads int `json:"min_reads"`
+	/* Fraction of valid barcodes, and of the read pairs with a valid barcode, below MinReads */
+	FractionBarcodesBelowMin float64 `json:"fraction_barcodes_below_min_reads"`
+	FractionReadsBelowMin    float64 `json:"fraction_reads_below_min_reads"`
+	/* Barcode length to number of read pairs */
+	BarcodeLengths map[int]int    `json:"barcode_lengths"`
+	TopBarcodes    []BarcodeCount `json:"top_barcodes"`
+	R1             *ReadStats     `json:"r1"`
+	R2             *ReadStats     `json:"r2"`
+}
+
+/*
+Stream paired FASTQ (or interleaved FASTQ/uBAM when r2 is empty) and
+gather barcode, read length and quality statistics. The input doesn't
+have to be sorted by barcode.
+*/
+func barcodeStats(r1, r2 string, minReads int, top int) (*BarcodeStats, error) {
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return nil, err
+	}
+	defer fqr.Close()
+
+	stats := &BarcodeStats{
+		ReadsPerBarcode: map[int]int{},
+		MinReads:        minReads,
+		BarcodeLengths:  map[int]int{},
+		R1:              &ReadStats{Lengths: map[int]int{}},
+		R2:              &ReadStats{Lengths: map[int]int{}},
+	}
+	valid := map[string]int{}
+	invalid := map[string]int{}
+	var record fastqreader.FastQRecord
+	for {
+		err := fqr.ReadOneLine(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.ReadPairs++
+		stats.R1.add(record.Read1, record.ReadQual1)
+		stats.R2.add(record.Read2, record.ReadQual2)
+		switch {
+		case len(record.Barcode) == 0:
+			stats.NoBarcodePairs++
+		case record.Valid:
+			stats.ValidPairs++
+			valid[string(record.Barcode)]++
+		default:
+			stats.InvalidPairs++
+			invalid[string(record.Barcode)]++
+		}
+		if len(record.Barcode) > 0 {
+			stats.BarcodeLengths[len(record.Barcode)]++
+		}
+	}
+	stats.R1.finish()
+	stats.R2.finish()
+
+	stats.ValidBarcodes = len(valid)
+	stats.InvalidBarcodes = len(invalid)
+	if stats.ReadPairs > 0 {
+		stats.FractionValid = float64(stats.ValidPairs) / float64(stats.ReadPairs)
+	}
+	belowBarcodes, belowReads := 0, 0
+	for _, n := range valid {
+		stats.ReadsPerBarcode[n]++
+		if n < minReads {
+			belowBarcodes++
+			belowReads += n
+		}
+	}
+	if len(valid) > 0 {
+		stats.MeanReadsPerBarcode = float64(stats.ValidPairs) / float64(len(valid))
+		stats.FractionBarcodesBelowMin = float64(belowBarcodes) / float64(len(valid))
+	}
+	if stats.ValidPairs > 0 {
+		stats.FractionReadsBelowMin = float64(belowReads) / float64(stats.ValidPairs)
+	}
+
+	/* Most read pairs first, ties broken by barcode so the report is reproducible */
+	counts := make([]BarcodeCount, 0, len(valid)+len(invalid))
+	for barcode, n := range valid {
+		counts = append(counts, BarcodeCount{barcode, n, true})
+	}
+	for barcode, n := range invalid {
+		counts = append(counts, BarcodeCount{barcode, n, false})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Reads != counts[j].Reads {
+			return counts[i].Reads > counts[j].Reads
+		}
+		return counts[i].Barcode < counts[j].Barcode
+	})
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	stats.TopBarcodes = counts
+	return stats, nil
+}
+
+/* Keys of a histogram in increasing order */
+func sortedKeys(histogram map[int]int) []int {
+	keys := make([]int, 0, len(histogram))
+	for k := range histogram {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+/*
+Write a TSV with MultiQC custom-content headers, so that MultiQC picks it
+up from a file named *_mqc.tsv.
+*/
+func writeMultiqcTsv(path string, id string, title string, plotType string, header string, rows func(w io.Writer)) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "# id: 'arachne_%s'\n# section_name: '%s'\n# plot_type: '%s'\n%s\n", id, title, plotType, header)
+	rows(w)
+	err = w.Flush()
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/* Write the stats as <prefix>.barcode_stats.json and a set of MultiQC-ready TSVs */
+func writeBarcodeStats(stats *BarcodeStats, prefix string) ([]string, error) {
+	var written []string
+	write := func(path string, err error) error {
+		if err == nil {
+			written = append(written, path)
+		}
+		return err
+	}
+
+	path := prefix + ".barcode_stats.json"
+	if err := write(path, writeJSONReport(path, stats)); err != nil {
+		return nil, err
+	}
+
+	path = prefix + ".barcode_summary_mqc.tsv"
+	err := writeMultiqcTsv(path, "barcode_summary", "Barcode summary", "table", "Sample\tread_pairs\tfraction_valid\tvalid_barcodes\tmean_reads_per_barcode\tfraction_barcodes_below_min_reads\tfraction_reads_below_min_reads\tr1_mean_length\tr2_mean_length\tr1_fraction_q30\tr2_fraction_q30", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%d\t%.4f\t%d\t%.2f\t%.4f\t%.4f\t%.1f\t%.1f\t%.4f\t%.4f\n", filepath.Base(prefix), stats.ReadPairs, stats.FractionValid,
+			stats.ValidBarcodes, stats.MeanReadsPerBarcode, stats.FractionBarcodesBelowMin, stats.FractionReadsBelowMin,
+			stats.R1.MeanLength, stats.R2.MeanLength, stats.R1.FractionQ30, stats.R2.FractionQ30)
+	})
+	if err := write(path, err); err != nil {
+		return nil, err
+	}
+
+	histograms := []struct {
+		id, title, column string
+		histogram         map[int]int
+	}{
+		{"reads_per_barcode", "Read pairs per valid barcode", "barcodes", stats.ReadsPerBarcode},
+		{"barcode_lengths", "Barcode length", "read_pairs", stats.BarcodeLengths},
+		{"r1_lengths", "R1 length", "reads", stats.R1.Lengths},
+		{"r2_lengths", "R2 length", "reads", stats.R2.Lengths},
+	}
+	for _, h := range histograms {
+		path = prefix + "." + h.id + "_mqc.tsv"
+		err := writeMultiqcTsv(path, h.id, h.title, "linegraph", h.id+"\t"+h.column, func(w io.Writer) {
+			for _, k := range sortedKeys(h.histogram) {
+				fmt.Fprintf(w, "%d\t%d\n", k, h.histogram[k])
+			}
+		})
+		if err := write(path, err); err != nil {
+			return nil, err
+		}
+	}
+
+	path = prefix + ".top_barcodes_mqc.tsv"
+	err = writeMultiqcTsv(path, "top_barcodes", "Most common barcodes", "table", "barcode\tread_pairs\tvalid", func(w io.Writer) {
+		for _, c := range stats.TopBarcodes {
+			fmt.Fprintf(w, "%s\t%d\t%t\n", c.Barcode, c.Reads, c.Valid)
+		}
+	})
+	if err := write(path, err); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+/*
+The "arachne barcode-stats" subcommand
+*/
+func BarcodeStatsCommand(args []string) {
+	flags := flag.NewFlagSet("barcode-stats", flag.ExitOnError)
+	var prefix string
+	var minReads int
+	var top int
+
+	flags.StringVar(&prefix, "output", "barcodes", "Prefix for the report files")
+	flags.StringVar(&prefix, "o", "barcodes", "Prefix for the report files")
+	flags.IntVar(&minReads, "min-reads", fastqreader.DefaultMinRFAReads, "Barcodes with fewer read pairs than this are too small for RFA")
+	flags.IntVar(&top, "top", 20, "Number of most common barcodes to list")
+
+	flags.Usage = func() {
+		printPairedUsage("barcode-stats <options>")
+		fmt.Fprint(os.Stderr, "\nReport barcode, read length and quality statistics for standard-format input, as JSON and MultiQC-ready TSV.")
+		fmt.Fprint(os.Stderr, "\nThe input does not need to be sorted.\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-o\033[0m/\033[35;1m--output\033[0m\n\tPrefix for the report files \033[90;1m(default: barcodes)\033[0m")
+		fmt.Fprintf(os.Stderr, "\n  \033[35;1m--min-reads\033[0m\n\tBarcodes with fewer read pairs than this are too small for RFA \033[90;1m(default: %d)\033[0m", fastqreader.DefaultMinRFAReads)
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--top\033[0m\n\tNumber of most common barcodes to list \033[90;1m(default: 20)\033[0m\n")
+	}
+
+	flags.Parse(args)
+	input_r1, input_r2 := pairedInputArgs(flags)
+
+	stats, err := barcodeStats(input_r1, input_r2, minReads, top)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	log.Printf("%d read pairs, %.1f%% with a valid barcode, %d valid barcodes (%.1f read pairs each on average)",
+		stats.ReadPairs, 100*stats.FractionValid, stats.ValidBarcodes, stats.MeanReadsPerBarcode)
+	log.Printf("%.1f%% of valid barcodes (%.1f%% of their read pairs) have fewer than %d read pairs",
+		100*stats.FractionBarcodesBelowMin, 100*stats.FractionReadsBelowMin, minReads)
+
+	written, err := writeBarcodeStats(stats, prefix)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	for _, path := range written {
+		fmt.Println(path)
+	}
+}
@@ -0,0 +1,115 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Layout of the barcode at the end of a raw stLFR read 2: three 10bp barcode
+segments separated by 6bp linkers, 42bp in all.
+*/
+const (
+	stlfrTailLength    = 42
+	stlfrSegmentLength = 10
+)
+
+var stlfrSegmentOffsets = [3]int{0, 16, 32}
+
+/*
+Raw BGI stLFR output, where the barcode hasn't been decoded into the read
+name yet and is still the last 42bp of read 2. Each segment is looked up
+in the stLFR barcode list (allowing one mismatch) and becomes one number of
+the x_y_z barcode, with 0 for a segment that isn't on the list. This can't
+be told apart from ordinary reads reliably, so it isn't registered for
+detection and is picked with "standardize --stlfr-barcodes".
+*/
+type rawStlfrFormat struct {
+	/* Segment sequence (and every sequence one mismatch from it) to its number, -1 if ambiguous */
+	segments map[string]int
+}
+
+/*
+Load an stLFR barcode list: one "SEQUENCE<TAB>number" line per barcode, as
+shipped with BGI's stLFR tools. Lines without a number are numbered in order.
+*/
+func LoadRawStlfrFormat(path string) (*rawStlfrFormat, error) {
+	source, err := fastqreader.FastZipReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	exact := map[string]int{}
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields[0]) != stlfrSegmentLength {
+			return nil, fmt.Errorf("%s: barcode %q is not %d bp long", path, fields[0], stlfrSegmentLength)
+		}
+		number := len(exact) + 1
+		if len(fields) > 1 {
+			number, err = strconv.Atoi(fields[1])
+			if err != nil || number <= 0 {
+				return nil, fmt.Errorf("%s: %q is not a barcode number", path, fields[1])
+			}
+		}
+		exact[strings.ToUpper(fields[0])] = number
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(exact) == 0 {
+		return nil, fmt.Errorf("%s: barcode list is empty", path)
+	}
+
+	return &rawStlfrFormat{segments: oneMismatchLookup(exact)}, nil
+}
+
+func (*rawStlfrFormat) Name() string { return "raw stlfr" }
+
+/* Read 2 has to at least be long enough to hold the barcode */
+func (*rawStlfrFormat) Detect(record fastqreader.FastQRecord) bool {
+	return len(record.Read2) > stlfrTailLength
+}
+
+/* Decode the three segments at the end of read 2 into x_y_z */
+func (f *rawStlfrFormat) ExtractBarcode(record fastqreader.FastQRecord) (string, string) {
+	if len(record.Read2) <= stlfrTailLength {
+		return "", record.ReadInfo
+	}
+	tail := record.Read2[len(record.Read2)-stlfrTailLength:]
+	var numbers [3]string
+	for i, offset := range stlfrSegmentOffsets {
+		number := f.segments[string(tail[offset:offset+stlfrSegmentLength])]
+		if number < 0 {
+			number = 0
+		}
+		numbers[i] = strconv.Itoa(number)
+	}
+	/* Any earlier decoding in the name is superseded */
+	_, name := barcodeFromName(stlfrRe, record.ReadInfo)
+	return strings.Join(numbers[:], "_"), name
+}
+
+func (*rawStlfrFormat) Validate(barcode string) bool {
+	return stlfrFormat{}.Validate(barcode)
+}
+
+/*
+The barcode isn't part of the insert, so take it off read 2. The qualities
+are cut to what is left of the read, which may be all of them if they were
+short to begin with.
+*/
+func (*rawStlfrFormat) TrimReads(record *fastqreader.FastQRecord) {
+	if len(record.Read2) > stlfrTailLength {
+		record.Read2 = record.Read2[:len(record.Read2)-stlfrTailLength]
+		record.ReadQual2 = record.ReadQual2[:min(len(record.ReadQual2), len(record.Read2))]
+	}
+}
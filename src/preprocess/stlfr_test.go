@@ -0,0 +1,28 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"strings"
+	"testing"
+)
+
+func TestRawStlfrTrimReads(t *testing.T) {
+	read2 := strings.Repeat("A", 100) + strings.Repeat("C", stlfrTailLength)
+	tests := []struct {
+		qual     int
+		wantQual int
+	}{
+		{len(read2), 100},
+		/* Malformed records with short qualities mustn't bring standardize down */
+		{120, 100},
+		{50, 50},
+		{0, 0},
+	}
+	for _, test := range tests {
+		record := fastqreader.FastQRecord{Read2: []byte(read2), ReadQual2: []byte(strings.Repeat("I", test.qual))}
+		(&rawStlfrFormat{}).TrimReads(&record)
+		if len(record.Read2) != 100 || len(record.ReadQual2) != test.wantQual {
+			t.Errorf("%d qualities: trimmed to %d bases and %d qualities, want 100 and %d", test.qual, len(record.Read2), len(record.ReadQual2), test.wantQual)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+)
+
+/*
+Settings for subsampleBarcodes.
+*/
+type SubsampleConfig struct {
+	/* Fraction of barcodes to keep, with all of their reads */
+	Fraction float64
+	/* Most read pairs to keep per barcode, 0 for no limit */
+	MaxReads int
+	/* Same seed, same subsample */
+	Seed uint64
+}
+
+/* Tally of what subsampleBarcodes kept */
+type SubsampleStats struct {
+	Barcodes     int
+	KeptBarcodes int
+	ReadPairs    int
+	KeptPairs    int
+	/* Barcodes that had more read pairs than MaxReads */
+	CappedBarcodes int
+}
+
+/* Hash a barcode with the seed, evenly over the whole uint64 range */
+func barcodeHash(seed uint64, barcode []byte) uint64 {
+	h := fnv.New64a()
+	for i := range 8 {
+		h.Write([]byte{byte(seed >> (8 * i))})
+	}
+	h.Write(barcode)
+	/* Mix the bits down, as FNV alone is weak in its high bits (murmur3 finalizer) */
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+/*
+One barcode's reads on their way through the subsampler: every one of
+them, or a reservoir sample of MaxReads of them once there are more.
+*/
+type barcodeSample struct {
+	barcode []byte
+	keep    bool
+	seen    int
+	records []fastqreader.FastQRecord
+	/* Position of each kept record among the barcode's reads, to restore their order */
+	order []int
+	rng   *rand.Rand
+}
+
+func (s *barcodeSample) add(record fastqreader.FastQRecord, maxReads int) {
+	position := s.seen
+	s.seen++
+	if maxReads <= 0 || len(s.records) < maxReads {
+		s.records = append(s.records, record)
+		s.order = append(s.order, position)
+		return
+	}
+	if slot := s.rng.IntN(s.seen); slot < maxReads {
+		s.records[slot] = record
+		s.order[slot] = position
+	}
+}
+
+/* The kept records, in input order */
+func (s *barcodeSample) sorted() []fastqreader.FastQRecord {
+	index := make([]int, len(s.records))
+	for i := range index {
+		index[i] = i
+	}
+	slices.SortFunc(index, func(a, b int) int { return s.order[a] - s.order[b] })
+	sorted := make([]fastqreader.FastQRecord, len(index))
+	for i, j := range index {
+		sorted[i] = s.records[j]
+	}
+	return sorted
+}
+
+/*
+Subsample barcode-sorted standard FASTQ (interleaved when r2 is empty) a
+barcode at a time, so that the read clouds that are kept stay whole.
+Whether a barcode is kept depends only on the seed and the barcode, so the
+same barcodes are picked from every library and on every run. Barcodes
+with more than MaxReads pairs are cut down to a seeded random MaxReads of
+them. Output is written to <prefix>.R1.fq.gz and <prefix>.R2.fq.gz.
+*/
+func subsampleBarcodes(r1, r2, prefix string, config SubsampleConfig) (*SubsampleStats, error) {
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return nil, err
+	}
+	defer fqr.Close()
+
+	outR1, outR2, err := createPairedGzipOutput(prefix+".R1.fq.gz", prefix+".R2.fq.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	/* Barcodes hashing below this are kept */
+	threshold := uint64(math.MaxUint64)
+	if config.Fraction < 1 {
+		threshold = uint64(config.Fraction * math.MaxUint64)
+	}
+
+	stats := &SubsampleStats{}
+	var current *barcodeSample
+	finish := func() {
+		if current == nil {
+			return
+		}
+		stats.Barcodes++
+		if !current.keep {
+			return
+		}
+		stats.KeptBarcodes++
+		if config.MaxReads > 0 && current.seen > config.MaxReads {
+			stats.CappedBarcodes++
+		}
+		var chunkR1, chunkR2 []byte
+		for _, record := range current.sorted() {
+			chunkR1 = fastqreader.AppendStandardRecord(chunkR1, &record, 1)
+			chunkR2 = fastqreader.AppendStandardRecord(chunkR2, &record, 2)
+			stats.KeptPairs++
+		}
+		outR1.Write(chunkR1)
+		outR2.Write(chunkR2)
+	}
+
+	var space []fastqreader.FastQRecord
+	for {
+		/* A barcode with a lot of reads comes back over several calls */
+		reads, err, _ := fqr.ReadBarcodeSet(&space)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			outR1.Close()
+			outR2.Close()
+			return nil, err
+		}
+		space = reads
+		if len(reads) == 0 {
+			continue
+		}
+		if current == nil || fastqreader.DifferentBarcode(current.barcode, reads[0].Barcode) {
+			finish()
+			hash := barcodeHash(config.Seed, reads[0].Barcode)
+			current = &barcodeSample{
+				barcode: slices.Clone(reads[0].Barcode),
+				keep:    hash <= threshold,
+				rng:     rand.New(rand.NewPCG(config.Seed, hash)),
+			}
+		}
+		stats.ReadPairs += len(reads)
+		if current.keep {
+			for _, record := range reads {
+				current.add(record, config.MaxReads)
+			}
+		}
+	}
+	finish()
+
+	errR1 := outR1.Close()
+	errR2 := outR2.Close()
+	return stats, errors.Join(errR1, errR2)
+}
+
+/*
+The "arachne subsample" subcommand
+*/
+func Subsample(args []string) {
+	flags := flag.NewFlagSet("subsample", flag.ExitOnError)
+	var prefix string
+	var config SubsampleConfig
+
+	flags.StringVar(&prefix, "output", "subsampled", "Prefix for the output files")
+	flags.StringVar(&prefix, "o", "subsampled", "Prefix for the output files")
+	flags.Float64Var(&config.Fraction, "fraction", 1, "Fraction of barcodes to keep")
+	flags.Float64Var(&config.Fraction, "f", 1, "Fraction of barcodes to keep")
+	flags.IntVar(&config.MaxReads, "max-reads", 0, "Most read pairs to keep per barcode (0 for no limit)")
+	flags.Uint64Var(&config.Seed, "seed", 1, "Seed for picking barcodes and reads")
+
+	flags.Usage = func() {
+		printPairedUsage("subsample <options>")
+		fmt.Fprint(os.Stderr, "\nSubsample barcode-sorted standard-format FASTQ by barcode, keeping whole read clouds. The same seed always")
+		fmt.Fprint(os.Stderr, "\npicks the same barcodes.\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-o\033[0m/\033[35;1m--output\033[0m\n\tPrefix for the output files, written as <prefix>.R1.fq.gz and <prefix>.R2.fq.gz \033[90;1m(default: subsampled)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-f\033[0m/\033[35;1m--fraction\033[0m\n\tFraction of barcodes to keep, with all of their reads \033[90;1m(default: 1)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--max-reads\033[0m\n\tMost read pairs to keep per barcode, sampled at random within the barcode \033[90;1m(default: no limit)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--seed\033[0m\n\tSeed for picking barcodes and reads \033[90;1m(default: 1)\033[0m\n")
+	}
+
+	flags.Parse(args)
+	input_r1, input_r2 := pairedInputArgs(flags)
+	if config.Fraction <= 0 || config.Fraction > 1 {
+		log.Fatalf("\033[31;1mError:\033[0m --fraction must be greater than 0 and at most 1, not %g\n", config.Fraction)
+	}
+	if config.MaxReads < 0 {
+		log.Fatalf("\033[31;1mError:\033[0m --max-reads can't be negative\n")
+	}
+	if config.Fraction == 1 && config.MaxReads == 0 {
+		log.Fatalf("\033[31;1mError:\033[0m nothing to do: give --fraction below 1 and/or --max-reads\n")
+	}
+
+	stats, err := subsampleBarcodes(input_r1, input_r2, prefix, config)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+	log.Printf("Kept %d of %d barcodes and %d of %d read pairs", stats.KeptBarcodes, stats.Barcodes, stats.KeptPairs, stats.ReadPairs)
+	if config.MaxReads > 0 {
+		log.Printf("%d barcodes had more than %d read pairs and were subsampled", stats.CappedBarcodes, config.MaxReads)
+	}
+	fmt.Println(prefix + ".R1.fq.gz")
+	fmt.Println(prefix + ".R2.fq.gz")
+}
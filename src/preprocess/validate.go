@@ -0,0 +1,238 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+/* One way in which the input doesn't follow the standard format */
+type Violation struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+/*
+The outcome of validating a set of standard-format FASTQ files.
+*/
+type ValidationReport struct {
+	R1        string `json:"r1"`
+	R2        string `json:"r2,omitempty"`
+	ReadPairs int    `json:"read_pairs"`
+	Barcodes  int    `json:"barcodes"`
+	/* Every barcode's reads are contiguous */
+	Sorted bool `json:"sorted"`
+	Valid  bool `json:"valid"`
+	/* Number of violations of each kind, including those not listed */
+	Counts     map[string]int `json:"counts"`
+	Violations []Violation    `json:"violations"`
+	/* Only the first this-many violations are kept */
+	MaxViolations int `json:"max_violations"`
+	/* Where input that couldn't be read any further ended the validation
+	 * (file and line), empty if all of it was checked
+	 */
+	Stopped string `json:"stopped,omitempty"`
+}
+
+func (r *ValidationReport) add(file string, line int, kind string, format string, args ...any) {
+	r.Counts[kind]++
+	if len(r.Violations) < r.MaxViolations {
+		r.Violations = append(r.Violations, Violation{file, line, kind, fmt.Sprintf(format, args...)})
+	}
+}
+
+/* Check the qualities of one read: same length as the sequence and printable Phred+33 */
+func checkRead(report *ValidationReport, file string, line int, seq, qual []byte) {
+	if len(seq) != len(qual) {
+		report.add(file, line+1, "length", "sequence is %d bp but there are %d qualities", len(seq), len(qual))
+	}
+	for _, q := range qual {
+		if q < '!' || q > '~' {
+			report.add(file, line+3, "quality", "quality %q is outside the Phred+33 range (! to ~)", q)
+			break
+		}
+	}
+}
+
+/* Check one half of a pair's header for the /1 or /2 suffix and the BX:Z and VX:i tags */
+func checkHeader(report *ValidationReport, file string, line int, header fastqreader.ReadHeader, mate int) {
+	if header.Mate != mate {
+		report.add(file, line, "suffix", "read %q doesn't end in /%d", header.Name, mate)
+	}
+	if header.Barcode == nil {
+		report.add(file, line, "bx", "read %q has no BX:Z tag", header.Name)
+	}
+	if !header.HasValid {
+		report.add(file, line, "vx", "read %q has no VX:i tag", header.Name)
+	} else if header.ValidText != "0" && header.ValidText != "1" {
+		report.add(file, line, "vx", "read %q has VX:i:%s, but VX:i is 0 or 1", header.Name, header.ValidText)
+	}
+}
+
+/*
+Stream paired FASTQ (or interleaved FASTQ when r2 is empty) and check it
+against the standard format: /1 and /2 suffixes, BX:Z and VX:i tags,
+matching read names, qualities that match the sequence and are in range,
+and every barcode's reads being contiguous. Problems that leave the files
+unreadable (truncation, a missing '+' line, one file running out before
+the other, ...) end the validation, and the report says where.
+*/
+func validateStandard(r1, r2 string, maxViolations int) (*ValidationReport, error) {
+	report := &ValidationReport{R1: r1, R2: r2, Counts: map[string]int{}, Violations: []Violation{}, MaxViolations: maxViolations}
+
+	fqr, err := fastqreader.OpenPairedFastQ(r1, r2)
+	if err != nil {
+		return nil, err
+	}
+	defer fqr.Close()
+	if fqr.Records != nil {
+		return nil, errors.New(r1 + ": only FASTQ input can be validated")
+	}
+
+	r2File := r2
+	if r2 == "" {
+		r2File = r1
+	}
+	/* Barcode to the R1 line its reads were first seen at */
+	seen := map[string]int{}
+	var last string
+	var record fastqreader.FastQRecord
+	for {
+		err := fqr.ReadOneLine(&record)
+		if err == io.EOF {
+			break
+		}
+		var parseErr *fastqreader.ParseError
+		if err != nil {
+			if !errors.As(err, &parseErr) {
+				return nil, err
+			}
+			file := r1
+			if parseErr.Source != "R1" {
+				file = r2File
+			}
+			report.add(file, parseErr.Line, "format", "%s", parseErr.Msg)
+			/* Mates that don't match were still read whole, so the pair is checked as well */
+			var mateErr *fastqreader.MateError
+			if !errors.As(err, &mateErr) {
+				report.Stopped = fmt.Sprintf("%s line %d", file, parseErr.Line)
+				break
+			}
+		}
+		report.ReadPairs++
+
+		/* The reader has already moved past the pair's 4 lines in each file */
+		r1Line, r2Line := fqr.R1Line-3, fqr.R2Line-3
+		if fqr.Interleaved {
+			r1Line, r2Line = fqr.R1Line-7, fqr.R1Line-3
+		}
+		checkHeader(report, r1, r1Line, fqr.R1Header, 1)
+		checkHeader(report, r2File, r2Line, fqr.R2Header, 2)
+		checkRead(report, r1, r1Line, record.Read1, record.ReadQual1)
+		checkRead(report, r2File, r2Line, record.Read2, record.ReadQual2)
+
+		barcode := string(record.Barcode)
+		if report.ReadPairs == 1 || barcode != last {
+			if first, ok := seen[barcode]; ok {
+				report.add(r1, r1Line, "unsorted", "barcode %q was already seen at line %d; the reads are not sorted by barcode", barcode, first)
+			} else {
+				seen[barcode] = r1Line
+			}
+			last = barcode
+		}
+	}
+
+	report.Barcodes = len(seen)
+	report.Sorted = report.Counts["unsorted"] == 0
+	report.Valid = len(report.Counts) == 0
+	return report, nil
+}
+
+/*
+The "arachne validate" subcommand
+*/
+func Validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	var maxViolations int
+	var jsonOut string
+
+	flags.IntVar(&maxViolations, "max-errors", 20, "Number of violations to report")
+	flags.IntVar(&maxViolations, "n", 20, "Number of violations to report")
+	flags.StringVar(&jsonOut, "json", "", "Also write the report as JSON to this file (- for stdout)")
+
+	flags.Usage = func() {
+		printPairedUsage("validate <options>")
+		fmt.Fprint(os.Stderr, "\nCheck that FASTQ files follow the standard linked-read format and are sorted by barcode.")
+		fmt.Fprint(os.Stderr, "\nExits with a non-zero status if they don't.\n")
+
+		fmt.Fprint(os.Stderr, "\n\033[35;1mOptions:\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m-n\033[0m/\033[35;1m--max-errors\033[0m\n\tNumber of violations to report \033[90;1m(default: 20)\033[0m")
+		fmt.Fprint(os.Stderr, "\n  \033[35;1m--json\033[0m\n\tAlso write the report as JSON to this file (\033[92;1m-\033[0m for stdout)\n")
+	}
+
+	flags.Parse(args)
+	input_r1, input_r2 := pairedInputArgs(flags)
+
+	report, err := validateStandard(input_r1, input_r2, maxViolations)
+	if err != nil {
+		log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+	}
+
+	for _, v := range report.Violations {
+		fmt.Fprintf(os.Stderr, "\033[31;1m%s\033[0m %s line %d: %s\n", v.Kind, v.File, v.Line, v.Message)
+	}
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("%d %s violation(s)", report.Counts[kind], kind)
+	}
+	status := "valid"
+	if !report.Valid {
+		status = "NOT valid"
+	}
+	if report.Stopped != "" {
+		log.Printf("Stopped at %s, which can't be read past; nothing after it was checked", report.Stopped)
+	}
+	log.Printf("Checked %d read pairs with %d barcodes: %s", report.ReadPairs, report.Barcodes, status)
+
+	if jsonOut != "" {
+		if err := writeJSONReport(jsonOut, report); err != nil {
+			log.Fatalf("\033[31;1mError:\033[0m %v\n", err)
+		}
+	}
+	if !report.Valid {
+		os.Exit(1)
+	}
+}
+
+/* Write a report as indented JSON to a file, or to stdout for "-" */
+func writeJSONReport(path string, report any) error {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		out, err = os.Create(path)
+		if err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(report)
+	if path != "-" {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package preprocess
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateStandard(t *testing.T) {
+	const pair = "@%s/%d\tBX:Z:%s\tVX:i:%s\nACGT\n+\nIIII\n"
+	record := func(name string, mate int, barcode, valid string) string {
+		return fmt.Sprintf(pair, name, mate, barcode, valid)
+	}
+	tests := []struct {
+		name    string
+		r1, r2  string
+		pairs   int
+		counts  map[string]int
+		stopped string
+	}{
+		{"valid",
+			record("a", 1, "AAAA", "1") + record("b", 1, "CCCC", "0"),
+			record("a", 2, "AAAA", "1") + record("b", 2, "CCCC", "0"),
+			2, map[string]int{}, ""},
+		{"VX:i other than 0 or 1",
+			record("a", 1, "AAAA", "2") + record("b", 1, "CCCC", "-1"),
+			record("a", 2, "AAAA", "1") + record("b", 2, "CCCC", "0"),
+			2, map[string]int{"vx": 2}, ""},
+		/* Names that don't match are reported, and the pairs after them still checked */
+		{"mismatched names",
+			record("a", 1, "AAAA", "1") + record("b", 1, "CCCC", "1") + record("c", 1, "AAAA", "1"),
+			record("a", 2, "AAAA", "1") + record("x", 2, "CCCC", "1") + record("c", 2, "AAAA", "1"),
+			3, map[string]int{"format": 1, "unsorted": 1}, ""},
+		{"truncated R2",
+			record("a", 1, "AAAA", "1") + record("b", 1, "CCCC", "1") + record("c", 1, "GGGG", "1"),
+			record("a", 2, "AAAA", "1") + "@b/2\tBX:Z:CCCC\tVX:i:1\nACGT\n",
+			1, map[string]int{"format": 1}, "R2.fq line 6"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		r1, r2 := filepath.Join(dir, "R1.fq"), filepath.Join(dir, "R2.fq")
+		if err := os.WriteFile(r1, []byte(test.r1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(r2, []byte(test.r2), 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := validateStandard(r1, r2, 20)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		stopped := report.Stopped
+		if stopped != "" {
+			stopped = stopped[len(dir)+1:]
+		}
+		if report.ReadPairs != test.pairs || len(report.Counts) != len(test.counts) || stopped != test.stopped {
+			t.Errorf("%s: %d read pairs, violations %v, stopped at %q; want %d, %v, %q",
+				test.name, report.ReadPairs, report.Counts, stopped, test.pairs, test.counts, test.stopped)
+			continue
+		}
+		for kind, count := range test.counts {
+			if report.Counts[kind] != count {
+				t.Errorf("%s: %d %s violations, want %d (%v)", test.name, report.Counts[kind], kind, count, report.Violations)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"bufio"
+	"fmt"
+	"log"
+	"strings"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+/* How two barcodes of the same length are allowed to differ */
+type DistanceMetric int
+
+const (
+	/* Substitutions only */
+	Hamming DistanceMetric = iota
+	/* Substitutions, plus an inserted or deleted base (which shifts the rest of the barcode by one) */
+	Edit
+)
+
+func ParseDistanceMetric(name string) (DistanceMetric, error) {
+	switch strings.ToLower(name) {
+	case "hamming":
+		return Hamming, nil
+	case "edit", "levenshtein":
+		return Edit, nil
+	}
+	return Hamming, fmt.Errorf("unknown distance metric %q (expected hamming or edit)", name)
+}
+
+/*
+Tally of what happened to every barcode checked against the whitelist.
+*/
+type CorrectionStats struct {
+	/* Already on the whitelist */
+	Exact int
+	/* Exactly one best whitelisted barcode within the allowed distance */
+	Corrected int
+	/* Several whitelisted barcodes equally close and equally likely */
+	Ambiguous int
+	/* Nothing on the whitelist within the allowed distance */
+	Uncorrectable int
+	/* No barcode to correct */
+	Missing int
+}
+
+func (s *CorrectionStats) Log() {
+	total := s.Exact + s.Corrected + s.Ambiguous + s.Uncorrectable + s.Missing
+	if total == 0 {
+		return
+	}
+	pct := func(n int) float64 { return 100 * float64(n) / float64(total) }
+	log.Printf("Barcode correction: %d exact (%.1f%%), %d corrected (%.1f%%), %d ambiguous (%.1f%%), %d uncorrectable (%.1f%%), %d without a barcode (%.1f%%)",
+		s.Exact, pct(s.Exact), s.Corrected, pct(s.Corrected), s.Ambiguous, pct(s.Ambiguous),
+		s.Uncorrectable, pct(s.Uncorrectable), s.Missing, pct(s.Missing))
+}
+
+/*
+Corrects barcodes against a whitelist of known barcodes. Barcodes within
+MaxDistance of a single whitelisted barcode are replaced by it. When
+several are equally close, the barcode's base qualities (if known) pick the
+one whose differences fall on the least certain bases.
+*/
+type BarcodeCorrector struct {
+	whitelist map[string]struct{}
+	/* Characters that appear in whitelisted barcodes, the candidates for a substitution */
+	alphabet    []byte
+	MaxDistance int
+	Metric      DistanceMetric
+	Stats       CorrectionStats
+}
+
+/*
+Most errors a barcode may be corrected for. Every barcode within the
+distance is looked up, and there are thousands of them at 2 errors (tens of
+thousands with edit distance), so a third would make correction crawl.
+*/
+const MaxCorrectionDistance = 2
+
+var qxTag = sam.NewTag("QX")
+var rxTag = sam.NewTag("RX")
+
+/* Read a whitelist: one barcode per line, in the first whitespace separated column */
+func LoadBarcodeCorrector(path string, maxDistance int, metric DistanceMetric) (*BarcodeCorrector, error) {
+	if maxDistance < 0 || maxDistance > MaxCorrectionDistance {
+		return nil, fmt.Errorf("barcodes can be corrected for 0 to %d errors, not %d", MaxCorrectionDistance, maxDistance)
+	}
+	source, err := fastqreader.FastZipReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	c := &BarcodeCorrector{whitelist: map[string]struct{}{}, MaxDistance: maxDistance, Metric: metric}
+	var seen [256]bool
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		c.whitelist[fields[0]] = struct{}{}
+		for i := 0; i < len(fields[0]); i++ {
+			seen[fields[0][i]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(c.whitelist) == 0 {
+		return nil, fmt.Errorf("%s: whitelist is empty", path)
+	}
+	for ch, ok := range seen {
+		if ok {
+			c.alphabet = append(c.alphabet, byte(ch))
+		}
+	}
+	log.Printf("Loaded %d whitelisted barcodes from %s", len(c.whitelist), path)
+	return c, nil
+}
+
+/*
+A barcode reachable from the observed one, and the summed Phred quality
+of the observed bases that had to be wrong to get there.
+*/
+type barcodeCandidate struct {
+	barcode string
+	penalty int
+}
+
+/*
+Call visit with every barcode one error away from b and the penalty of the
+error. The barcode length never changes: an insertion pushes the last base
+off the end and a deletion pulls in an unknown base at the end. The slice
+visit gets is reused for the next barcode, so it must be copied to be kept.
+*/
+func (c *BarcodeCorrector) eachNeighbour(b string, qual []byte, buf []byte, visit func(neighbour []byte, q int)) {
+	n := len(b)
+	for i := 0; i < n; i++ {
+		q := baseQuality(qual, i)
+		buf = append(buf[:0], b...)
+		for _, ch := range c.alphabet {
+			if ch != b[i] {
+				buf[i] = ch
+				visit(buf, q)
+			}
+		}
+		if c.Metric == Edit {
+			for _, ch := range c.alphabet {
+				/* the base at i was spurious */
+				buf = append(append(buf[:0], b[:i]...), b[i+1:]...)
+				buf = append(buf, ch)
+				visit(buf, q)
+				/* a base before i was skipped */
+				buf = append(append(buf[:0], b[:i]...), ch)
+				buf = append(buf, b[i:n-1]...)
+				visit(buf, q)
+			}
+		}
+	}
+}
+
+/*
+Every barcode one error away from each of "from", with the smallest penalty
+it can be reached with. Barcodes already in seen (reachable with fewer
+errors) are left out, and the ones returned are added to it, so that each
+barcode is only ever expanded once.
+*/
+func (c *BarcodeCorrector) neighbours(from []barcodeCandidate, qual []byte, seen map[string]int) []barcodeCandidate {
+	var next []barcodeCandidate
+	buf := make([]byte, 0, 64)
+	for _, cand := range from {
+		c.eachNeighbour(cand.barcode, qual, buf, func(neighbour []byte, q int) {
+			i, ok := seen[string(neighbour)]
+			switch {
+			case !ok:
+				seen[string(neighbour)] = len(next)
+				next = append(next, barcodeCandidate{string(neighbour), cand.penalty + q})
+			case i >= 0:
+				next[i].penalty = min(next[i].penalty, cand.penalty+q)
+			}
+		})
+	}
+	/* Done with this level: mark its barcodes as reached with fewer errors than the next */
+	for _, cand := range next {
+		seen[cand.barcode] = -1
+	}
+	return next
+}
+
+/* Phred quality of base i, or a flat 30 if the barcode has no qualities */
+func baseQuality(qual []byte, i int) int {
+	if i < len(qual) && qual[i] >= 33 {
+		return int(qual[i] - 33)
+	}
+	return 30
+}
+
+/*
+Find the closest whitelisted barcode. Returns the correction and true, or
+"" and false along with whether the failure was a tie.
+*/
+func (c *BarcodeCorrector) correct(barcode string, qual []byte) (string, bool, bool) {
+	frontier := []barcodeCandidate{{barcode, 0}}
+	seen := map[string]int{barcode: -1}
+	buf := make([]byte, 0, 64)
+	for distance := 1; distance <= c.MaxDistance; distance++ {
+		/* Whitelisted barcodes one more error away, with their smallest penalty */
+		best := map[string]int{}
+		for _, cand := range frontier {
+			c.eachNeighbour(cand.barcode, qual, buf, func(neighbour []byte, q int) {
+				if _, ok := c.whitelist[string(neighbour)]; ok {
+					if p, ok := best[string(neighbour)]; !ok || cand.penalty+q < p {
+						best[string(neighbour)] = cand.penalty + q
+					}
+				}
+			})
+		}
+		if len(best) == 0 {
+			/* Only expand the frontier if there is another level to look in */
+			if distance < c.MaxDistance {
+				frontier = c.neighbours(frontier, qual, seen)
+			}
+			continue
+		}
+		/* The most likely error is the one at the least certain bases */
+		winner, winnerPenalty, tied := "", 0, false
+		for b, p := range best {
+			switch {
+			case winner == "" || p < winnerPenalty:
+				winner, winnerPenalty, tied = b, p, false
+			case p == winnerPenalty:
+				tied = true
+			}
+		}
+		if tied {
+			return "", false, true
+		}
+		return winner, true, false
+	}
+	return "", false, false
+}
+
+/*
+Check a standardized record's barcode against the whitelist. A barcode is
+valid exactly when it is (or is corrected to) a whitelisted one. qual has a
+Phred+33 quality for each character of the barcode (see barcodeQuality),
+or is nil. Corrected records keep the barcode as sequenced in an RX tag.
+*/
+func (c *BarcodeCorrector) Correct(record *fastqreader.FastQRecord, qual []byte) {
+	if len(record.Barcode) == 0 {
+		c.Stats.Missing++
+		record.Valid = false
+		return
+	}
+	barcode := string(record.Barcode)
+	if _, ok := c.whitelist[barcode]; ok {
+		c.Stats.Exact++
+		record.Valid = true
+		return
+	}
+
+	corrected, ok, tied := c.correct(barcode, qual)
+	switch {
+	case ok:
+		c.Stats.Corrected++
+		record.Barcode = []byte(corrected)
+		record.Valid = true
+		if !hasTag(record.Tags, rxTag) {
+			raw, _ := sam.NewAux(rxTag, barcode)
+			withTag(record, raw)
+		}
+	case tied:
+		c.Stats.Ambiguous++
+		record.Valid = false
+	default:
+		c.Stats.Uncorrectable++
+		record.Valid = false
+	}
+}
@@ -0,0 +1,118 @@
+package preprocess
+
+import (
+	"arachne/src/fastqreader"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sam "github.com/biogo/hts/sam"
+)
+
+func loadTestCorrector(t *testing.T, whitelist []string, maxDistance int, metric DistanceMetric) *BarcodeCorrector {
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(whitelist, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadBarcodeCorrector(path, maxDistance, metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+/* The value of a tag, or "" if the record doesn't have it */
+func tagValue(record fastqreader.FastQRecord, tag string) string {
+	for _, aux := range record.Tags {
+		if aux.Tag() == sam.NewTag(tag) {
+			return aux.String()[5:]
+		}
+	}
+	return ""
+}
+
+func TestBarcodeCorrection(t *testing.T) {
+	whitelist := []string{"AAAA", "AACC", "TTTT", "TTGG", "GGGG"}
+	tests := []struct {
+		name    string
+		metric  DistanceMetric
+		barcode string
+		qual    string
+		want    string
+		valid   bool
+		stats   CorrectionStats
+	}{
+		{"exact", Hamming, "AAAA", "", "AAAA", true, CorrectionStats{Exact: 1}},
+		{"one candidate", Hamming, "GGGC", "", "GGGG", true, CorrectionStats{Corrected: 1}},
+		{"two candidates without qualities", Hamming, "AAAC", "", "AAAC", false, CorrectionStats{Ambiguous: 1}},
+		{"two candidates with equal qualities", Hamming, "AAAC", "IIII", "AAAC", false, CorrectionStats{Ambiguous: 1}},
+		{"two candidates, third base uncertain", Hamming, "AAAC", "II#I", "AACC", true, CorrectionStats{Corrected: 1}},
+		{"two candidates, last base uncertain", Hamming, "AAAC", "III#", "AAAA", true, CorrectionStats{Corrected: 1}},
+		{"too far", Hamming, "CATG", "", "CATG", false, CorrectionStats{Uncorrectable: 1}},
+		{"skipped base as substitutions", Hamming, "TGGT", "", "TGGT", false, CorrectionStats{Uncorrectable: 1}},
+		{"skipped base", Edit, "TGGT", "", "TTGG", true, CorrectionStats{Corrected: 1}},
+		{"no barcode", Hamming, "", "", "", false, CorrectionStats{Missing: 1}},
+	}
+	for _, test := range tests {
+		c := loadTestCorrector(t, whitelist, 1, test.metric)
+		record := fastqreader.FastQRecord{Barcode: []byte(test.barcode), Valid: true}
+		var qual []byte
+		if test.qual != "" {
+			qual = []byte(test.qual)
+		}
+		c.Correct(&record, qual)
+		if string(record.Barcode) != test.want || record.Valid != test.valid || c.Stats != test.stats {
+			t.Errorf("%s: %s became %s (valid %v, %+v), want %s (valid %v, %+v)",
+				test.name, test.barcode, record.Barcode, record.Valid, c.Stats, test.want, test.valid, test.stats)
+		}
+		raw := tagValue(record, "RX")
+		if corrected := test.stats.Corrected > 0; corrected != (raw != "") || (corrected && raw != test.barcode) {
+			t.Errorf("%s: RX:Z:%s after correcting %s", test.name, raw, test.barcode)
+		}
+	}
+}
+
+func TestBeadtagQuality(t *testing.T) {
+	/* A and C from I1, B and D from I2, 6 bases each; C and D have a poor base */
+	i1, i2 := "IIIIIII#IIII", "IIIIIIIIIII5"
+	want := "III###III555"
+	index := &haplotaggingIndexFormat{schema: defaultBeadtagSchema, length: 6}
+	if got := index.BarcodeCharQuality(fastqreader.FastQRecord{IndexQual: [][]byte{[]byte(i1), []byte(i2)}}); string(got) != want {
+		t.Errorf("from index reads: %q, want %q", got, want)
+	}
+
+	for _, sep := range []string{"+", "-"} {
+		rx, _ := sam.NewAux(rxTag, "ACGTACGTACGT"+sep+"ACGTACGTACGT")
+		qx, _ := sam.NewAux(qxTag, i1+sep+i2)
+		record := fastqreader.FastQRecord{Tags: []sam.Aux{rx, qx}}
+		if got := (haplotaggingFormat{defaultBeadtagSchema}).BarcodeCharQuality(record); string(got) != want {
+			t.Errorf("from RX/QX joined by %s: %q, want %q", sep, got, want)
+		}
+	}
+}
+
+/* Haplotagging reads whose barcode is a digit away from two whitelisted beadtags */
+func TestBeadtagCorrectionByQuality(t *testing.T) {
+	c := loadTestCorrector(t, []string{"A01C01B01D01", "A01C02B01D02"}, 1, Hamming)
+	format := haplotaggingFormat{defaultBeadtagSchema}
+	tests := []struct {
+		qx   string
+		want string
+	}{
+		/* D was read less certainly than C, so D is what was misread */
+		{"IIIIIIIIIIII+IIIIIIIII#II", "A01C01B01D01"},
+		{"IIIIIIIII#II+IIIIIIIIIIII", "A01C02B01D02"},
+		{"IIIIIIIIIIII+IIIIIIIIIIII", "A01C01B01D02"},
+	}
+	for _, test := range tests {
+		rx, _ := sam.NewAux(rxTag, "ACGTACGTACGT+ACGTACGTACGT")
+		qx, _ := sam.NewAux(qxTag, test.qx)
+		input := fastqreader.FastQRecord{Barcode: []byte("A01C01B01D02"), Tags: []sam.Aux{rx, qx}}
+		record := standardizeRecord(format, input)
+		c.Correct(&record, barcodeQuality(format, input, record))
+		if string(record.Barcode) != test.want {
+			t.Errorf("QX:Z:%s: corrected to %s, want %s", test.qx, record.Barcode, test.want)
+		}
+	}
+}